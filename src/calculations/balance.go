@@ -0,0 +1,108 @@
+/*
+ * This process calculates point values based of predefined formulas and configured parcels.
+ * All data is read from and results are written to the MongoDB server.
+ * {json:scada} - Copyright (c) 2020 - 2023 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const formulaBalanceCheck = 56
+
+// balanceCheckForm is the balanceCheck sub-document of a calculated point with formula 56
+type balanceCheckForm struct {
+	OutParcels   []interface{} `bson:"outParcels"`   // point keys (_id) or tag names of flows out
+	AbsTolerance float64       `bson:"absTolerance"` // absolute tolerance for the residual
+	PctTolerance float64       `bson:"pctTolerance"` // tolerance as a percentage of the largest of total in/out flows
+	Delay        float64       `bson:"delay"`        // time in seconds the residual must exceed the tolerance to flag imbalance
+	FlagPoint    interface{}   `bson:"flagPoint"`    // point key (_id) or tag name of the digital imbalance flag
+}
+
+// balanceCheck holds the resolved configuration and state of a balance check
+type balanceCheck struct {
+	idOutParcels  []int
+	absTolerance  float64
+	pctTolerance  float64
+	delay         time.Duration
+	idFlag        int       // key of the imbalance flag point, 0 when not configured
+	exceededSince time.Time // time when the residual exceeded the tolerance, zero when within tolerance
+}
+
+func newBalanceCheck(form *balanceCheckForm, resolve func(ref interface{}) (int, bool)) *balanceCheck {
+	b := &balanceCheck{
+		idOutParcels: []int{},
+		absTolerance: math.Abs(form.AbsTolerance),
+		pctTolerance: math.Abs(form.PctTolerance),
+		delay:        time.Duration(form.Delay * float64(time.Second)),
+	}
+	for _, parcel := range form.OutParcels {
+		if key, ok := resolve(parcel); ok {
+			b.idOutParcels = append(b.idOutParcels, key)
+		}
+	}
+	if form.FlagPoint != nil {
+		if key, ok := resolve(form.FlagPoint); ok {
+			b.idFlag = key
+		}
+	}
+	return b
+}
+
+// Computes the residual (sum of in flows - sum of out flows) and updates the imbalance condition.
+// Imbalance is true when the residual exceeds the tolerance for longer than the configured delay.
+func (b *balanceCheck) evaluate(idInParcels []int, vals map[int]float64, invalids map[int]bool, now time.Time) (residual float64, invalid bool, imbalance bool) {
+	sumIn, sumOut := 0.0, 0.0
+	for _, elem := range idInParcels {
+		sumIn += vals[elem]
+		invalid = invalid || invalids[elem]
+	}
+	for _, elem := range b.idOutParcels {
+		sumOut += vals[elem]
+		invalid = invalid || invalids[elem]
+	}
+	residual = sumIn - sumOut
+
+	tolerance := math.Max(b.absTolerance, b.pctTolerance/100*math.Max(math.Abs(sumIn), math.Abs(sumOut)))
+	if invalid || math.Abs(residual) <= tolerance {
+		b.exceededSince = time.Time{}
+		return residual, invalid, false
+	}
+	if b.exceededSince.IsZero() {
+		b.exceededSince = now
+	}
+	return residual, invalid, now.Sub(b.exceededSince) >= b.delay
+}
+
+// Returns the update operation for the imbalance flag point when its value or quality changed, nil otherwise
+func (b *balanceCheck) flagUpdate(imbalance bool, invalid bool, vals map[int]float64, invalids map[int]bool) mongo.WriteModel {
+	if b.idFlag == 0 {
+		return nil
+	}
+	val := 0.0
+	if imbalance {
+		val = 1
+	}
+	if val == vals[b.idFlag] && invalid == invalids[b.idFlag] {
+		return nil
+	}
+	return newCalcUpdate(b.idFlag, val, invalid, false)
+}
@@ -0,0 +1,84 @@
+/*
+ * This process calculates point values based of predefined formulas and configured parcels.
+ * All data is read from and results are written to the MongoDB server.
+ * {json:scada} - Copyright (c) 2020 - 2023 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBalanceCheckEvaluate(t *testing.T) {
+	vals := map[int]float64{1: 100, 2: 50, 3: 140, 4: 5}
+	tests := []struct {
+		name     string
+		abs      float64
+		pct      float64
+		in       []int
+		out      []int
+		invalids map[int]bool
+		residual float64
+		exceeded bool // residual over the tolerance
+	}{
+		{"balanced", 0, 0, []int{1, 2}, []int{3, 4}, nil, 5, true},
+		{"within absolute tolerance", 5, 0, []int{1, 2}, []int{3, 4}, nil, 5, false},
+		{"within percent tolerance", 1, 4, []int{1, 2}, []int{3, 4}, nil, 5, false}, // 4% of 150 = 6
+		{"over both tolerances", 4, 3, []int{1, 2}, []int{3, 4}, nil, 5, true},      // max(4, 4.5)
+		{"negative tolerances as absolute", -6, 0, []int{1, 2}, []int{3, 4}, nil, 5, false},
+		{"negative residual", 2, 0, []int{1}, []int{3}, nil, -40, true},
+		{"invalid parcel", 0, 0, []int{1, 2}, []int{3, 4}, map[int]bool{4: true}, 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBalanceCheck(&balanceCheckForm{AbsTolerance: tt.abs, PctTolerance: tt.pct}, func(ref interface{}) (int, bool) { return 0, false })
+			b.idOutParcels = tt.out
+			now := time.Now()
+			residual, invalid, imbalance := b.evaluate(tt.in, vals, tt.invalids, now)
+			if residual != tt.residual || invalid != (tt.invalids != nil) || imbalance != tt.exceeded {
+				t.Errorf("got %v %v %v, want %v %v %v", residual, invalid, imbalance, tt.residual, tt.invalids != nil, tt.exceeded)
+			}
+		})
+	}
+}
+
+func TestBalanceCheckDelay(t *testing.T) {
+	vals := map[int]float64{1: 100, 2: 90}
+	b := newBalanceCheck(&balanceCheckForm{AbsTolerance: 5, Delay: 30}, func(ref interface{}) (int, bool) { return 0, false })
+	b.idOutParcels = []int{2}
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		at        time.Duration
+		out       float64
+		imbalance bool
+	}{
+		{0, 90, false},                // exceeded, delay starts
+		{29 * time.Second, 90, false}, // still within the delay
+		{30 * time.Second, 90, true},  // delay elapsed
+		{31 * time.Second, 97, false}, // back within tolerance, delay reset
+		{40 * time.Second, 90, false}, // exceeded again, delay restarts
+		{69 * time.Second, 90, false},
+		{70 * time.Second, 90, true},
+	}
+	for _, s := range steps {
+		vals[2] = s.out
+		if _, _, imbalance := b.evaluate([]int{1}, vals, nil, t0.Add(s.at)); imbalance != s.imbalance {
+			t.Errorf("at %s: imbalance %v, want %v", s.at, imbalance, s.imbalance)
+		}
+	}
+}
@@ -70,8 +70,12 @@ type config struct {
 }
 
 type pointCalc struct {
-	calc      int
-	idParcels []int
+	calc       int
+	tag        string
+	idParcels  []int
+	unresolved []string      // parcels referenced by tag names (or calendars) not found, invalid configurations
+	balance    *balanceCheck // balance check configuration and state (formula 56)
+	calendar   *calendarCalc // calendar configuration and state (formulas 57-61)
 }
 
 type realtimeData struct {
@@ -81,21 +85,27 @@ type realtimeData struct {
 }
 
 type realtimeDataForm struct {
-	ID      int   `bson:"_id"`
-	FORMULA int   `bson:"formula"`
-	PARCELS []int `bson:"parcels"`
+	ID       int               `bson:"_id"`
+	TAG      string            `bson:"tag"`
+	FORMULA  int               `bson:"formula"`
+	PARCELS  []interface{}     `bson:"parcels"` // point keys (_id) or tag names
+	BALANCE  *balanceCheckForm `bson:"balanceCheck"`
+	CALENDAR *calendarCalcForm `bson:"calendar"`
+	VALUE    float64           `bson:"value"`
+	TIMETAG  time.Time         `bson:"timeTag"`
 }
 
 type processInstance struct {
-	ProcessName                string    `bson:"processName"`
-	ProcessInstanceNumber      int       `bson:"processInstanceNumber"`
-	Enabled                    bool      `bson:"enabled"`
-	LogLevel                   int       `bson:"logLevel"`
-	NodeNames                  []string  `bson:"nodeNames"`
-	ActiveNodeName             string    `bson:"activeNodeName"`
-	ActiveNodeKeepAliveTimeTag time.Time `bson:"activeNodeKeepAliveTimeTag"`
-	SoftwareVersion            string    `bson:"softwareVersion"`
-	PeriodOfCalculation        float64   `bson:"periodOfCalculation"`
+	ProcessName                string        `bson:"processName"`
+	ProcessInstanceNumber      int           `bson:"processInstanceNumber"`
+	Enabled                    bool          `bson:"enabled"`
+	LogLevel                   int           `bson:"logLevel"`
+	NodeNames                  []string      `bson:"nodeNames"`
+	ActiveNodeName             string        `bson:"activeNodeName"`
+	ActiveNodeKeepAliveTimeTag time.Time     `bson:"activeNodeKeepAliveTimeTag"`
+	SoftwareVersion            string        `bson:"softwareVersion"`
+	PeriodOfCalculation        float64       `bson:"periodOfCalculation"`
+	TracePoints                []interface{} `bson:"tracePoints"`
 }
 
 // Reads the config file
@@ -107,7 +117,7 @@ func readConfigFile(cfg *config) {
 	// tries to open and read the json config file
 	jsonFile, err := os.Open(configFileCompletePath)
 	if err != nil {
-		log.Printf("Fail to read file: %v", err)
+		logMain.Error("Fail to read config file", "file", configFileCompletePath, "error", err)
 		os.Exit(1)
 	}
 	byteValue, _ := io.ReadAll(jsonFile)
@@ -115,7 +125,7 @@ func readConfigFile(cfg *config) {
 	// unmarshals the json file's content into a config structure
 	err = json.Unmarshal(byteValue, &cfg)
 	if err != nil {
-		log.Printf("Error parsing json config file: %v", err)
+		logMain.Error("Error parsing json config file", "file", configFileCompletePath, "error", err)
 		os.Exit(1)
 	}
 
@@ -123,7 +133,7 @@ func readConfigFile(cfg *config) {
 	cfg.MongoDatabaseName = strings.TrimSpace(cfg.MongoDatabaseName)
 	cfg.NodeName = strings.TrimSpace(cfg.NodeName)
 	if cfg.MongoConnectionString == "" || cfg.MongoDatabaseName == "" || cfg.NodeName == "" {
-		log.Printf("Empty string in config file.")
+		logMain.Error("Empty string in config file", "file", configFileCompletePath)
 		os.Exit(1)
 	}
 	if cfg.TLSCaPemFile != "" || cfg.TLSClientPemFile != "" {
@@ -183,7 +193,7 @@ func processRedundancy(cfg config) {
 	for range time.Tick(time.Duration(5)*time.Second + time.Duration(100*r.Float64())*time.Millisecond) {
 
 		if mongoClient == nil { // not connected?
-			log.Println("Redundancy - Disconnected from Mongodb server!")
+			logRedundancy.Error("Disconnected from Mongodb server!")
 			continue
 		}
 
@@ -192,11 +202,10 @@ func processRedundancy(cfg config) {
 		filter := bson.D{{Key: "processName", Value: processName}}
 		err := collectionProcessInstances.FindOne(context.TODO(), filter).Decode(&instance)
 		if err != nil && err != mongo.ErrNoDocuments {
-			log.Println("Redundancy - Error querying processInstances!")
-			log.Println(err)
+			logRedundancy.Error("Error querying processInstances!", "error", err)
 		} else {
 			if err == mongo.ErrNoDocuments {
-				log.Println("Redundancy - No process instance found!")
+				logRedundancy.Warn("No process instance found!")
 				_, err := collectionProcessInstances.InsertOne(context.TODO(),
 					bson.M{
 						"processName":                processName,
@@ -210,14 +219,13 @@ func processRedundancy(cfg config) {
 						"periodOfCalculation":        periodOfCalculation,
 					})
 				if err != nil {
-					log.Println("Redundancy - Error inserting in processInstances!")
-					log.Println(err)
+					logRedundancy.Error("Error inserting in processInstances!", "error", err)
 					os.Exit(2)
 				}
 				continue
 			} else {
 				if !instance.Enabled {
-					log.Println("Redundancy - Process instance disabled!")
+					logRedundancy.Warn("Process instance disabled!")
 					os.Exit(0)
 				}
 				if len(instance.NodeNames) > 0 { // check if node names allowed are limited
@@ -229,27 +237,34 @@ func processRedundancy(cfg config) {
 						}
 					}
 					if !found {
-						log.Println("Redundancy - Node name not allowed!")
+						logRedundancy.Warn("Node name not allowed!", "nodeName", cfg.NodeName)
 						os.Exit(0)
 					}
 				}
 				if instance.LogLevel > logLevel {
-					logLevel = instance.LogLevel
-					log.Println("Redundancy - Log level updated to ", logLevel)
+					setLogLevel(instance.LogLevel)
+					logRedundancy.Info("Log level updated", "logLevel", logLevel)
+				}
+				if instance.TracePoints != nil { // replaces the trace filter of JS_CALCULATIONS_TRACE
+					f := newTraceFilter(instance.TracePoints)
+					if f.String() != tracePoints.Load().String() {
+						tracePoints.Store(f)
+						logRedundancy.Info("Traced points updated", "trace", f.String())
+					}
 				}
 				if instance.PeriodOfCalculation > periodOfCalculation {
 					periodOfCalculation = instance.PeriodOfCalculation
-					log.Println("Redundancy - Period of calculation updated to ", periodOfCalculation)
+					logRedundancy.Info("Period of calculation updated", "period", periodOfCalculation)
 				}
 				// check node active
 				if instance.ActiveNodeName == cfg.NodeName {
 					if isActive == false {
-						log.Println("Redundancy - ACTIVATING this Node!")
+						logRedundancy.Info("ACTIVATING this Node!")
 					}
 					isActive = true
 				} else {
 					if isActive { // was active, other node assumed, so be inactive and wait a random time
-						log.Println("Redundancy - DEACTIVATING this Node (other node active)!")
+						logRedundancy.Info("DEACTIVATING this Node (other node active)!")
 						countKeepAliveUpdates = 0
 						isActive = false
 						time.Sleep(time.Duration(1000) * time.Millisecond)
@@ -260,13 +275,13 @@ func processRedundancy(cfg config) {
 					}
 					lastActiveNodeKeepAliveTimeTag = instance.ActiveNodeKeepAliveTimeTag
 					if countKeepAliveUpdates > countKeepAliveUpdatesLimit { // time exceeded, be active
-						log.Println("Redundancy - ACTIVATING this Node!")
+						logRedundancy.Info("ACTIVATING this Node!")
 						isActive = true
 					}
 
 				}
 				if isActive {
-					log.Println("Redundancy - This node is active.")
+					logRedundancy.Info("This node is active.")
 
 					// update keep alive time and node name
 					_, err := collectionProcessInstances.UpdateOne(
@@ -275,11 +290,10 @@ func processRedundancy(cfg config) {
 						bson.M{"$set": bson.M{"activeNodeName": cfg.NodeName, "activeNodeKeepAliveTimeTag": bson.NewDateTimeFromTime(time.Now())}},
 					)
 					if err != nil {
-						log.Println("Redundancy - Error updating in processInstances!")
-						log.Println(err)
+						logRedundancy.Error("Error updating in processInstances!", "error", err)
 					}
 				} else {
-					log.Println("Redundancy - This node is inactive.")
+					logRedundancy.Info("This node is inactive.")
 				}
 
 			}
@@ -296,17 +310,39 @@ func __() {
 	_ = driverManager
 }
 
+// Creates the update operation for a calculated point
+func newCalcUpdate(id int, val float64, invalid bool, transient bool) mongo.WriteModel {
+	oper := mongo.NewUpdateOneModel()
+	oper.Filter = bson.D{
+		{Key: "_id", Value: id},
+	}
+	oper.Update = bson.D{{
+		Key: "$set", Value: bson.D{{
+			Key: "sourceDataUpdate",
+			Value: bson.D{
+				{Key: "valueAtSource", Value: val},
+				{Key: "invalidAtSource", Value: invalid},
+				{Key: "transientAtSource", Value: transient},
+				{Key: "timeTag", Value: time.Now()},
+			},
+		}},
+	}}
+	return oper
+}
+
 func main() {
-	log.SetOutput(os.Stdout) // log to standard output
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	log.Println(appMsg)
-	log.Println(appUsage)
-	log.Println(appUsageDefaults)
+	if err := setupLogging(os.Getenv("JS_CALCULATIONS_LOG_FORMAT")); err != nil {
+		log.Println("JS_CALCULATIONS_LOG_FORMAT environment variable should be text or json!")
+		os.Exit(2)
+	}
+	logMain.Info(appMsg)
+	logMain.Info(appUsage)
+	logMain.Info(appUsageDefaults)
 
 	if os.Getenv("JS_CALCULATIONS_INSTANCE") != "" {
 		i, err := strconv.Atoi(os.Getenv("JS_CALCULATIONS_INSTANCE"))
 		if err != nil {
-			log.Println("JS_CALCULATIONS_INSTANCE environment variable should be a number!")
+			logMain.Error("JS_CALCULATIONS_INSTANCE environment variable should be a number!")
 			os.Exit(2)
 		}
 		instanceNumber = i
@@ -314,7 +350,7 @@ func main() {
 	if len(os.Args) > 1 {
 		i, err := strconv.Atoi(os.Args[1])
 		if err != nil {
-			log.Println("Instance parameter should be a number!")
+			logMain.Error("Instance parameter should be a number!")
 			os.Exit(2)
 		}
 		instanceNumber = i
@@ -322,7 +358,7 @@ func main() {
 	if os.Getenv("JS_CALCULATIONS_LOGLEVEL") != "" {
 		i, err := strconv.Atoi(os.Getenv("JS_CALCULATIONS_LOGLEVEL"))
 		if err != nil {
-			log.Println("JS_CALCULATIONS_LOGLEVEL environment variable should be a number!")
+			logMain.Error("JS_CALCULATIONS_LOGLEVEL environment variable should be a number!")
 			os.Exit(2)
 		}
 		logLevel = i
@@ -330,7 +366,7 @@ func main() {
 	if len(os.Args) > 2 {
 		i, err := strconv.Atoi(os.Args[2])
 		if err != nil {
-			log.Println("Log Level parameter should be a number!")
+			logMain.Error("Log Level parameter should be a number!")
 			os.Exit(2)
 		}
 		logLevel = i
@@ -338,7 +374,7 @@ func main() {
 	if os.Getenv("JS_CALCULATIONS_PERIOD") != "" {
 		f, err := strconv.ParseFloat(os.Getenv("JS_CALCULATIONS_PERIOD"), 64)
 		if err != nil {
-			log.Println("JS_CALCULATIONS_PERIOD environment variable should be a number!")
+			logMain.Error("JS_CALCULATIONS_PERIOD environment variable should be a number!")
 			os.Exit(2)
 		}
 		periodOfCalculation = f
@@ -346,7 +382,7 @@ func main() {
 	if len(os.Args) > 3 {
 		f, err := strconv.ParseFloat(os.Args[3], 64)
 		if err != nil {
-			log.Println("Period of Calculation parameter should be a number!")
+			logMain.Error("Period of Calculation parameter should be a number!")
 			os.Exit(2)
 		}
 		periodOfCalculation = f
@@ -357,78 +393,61 @@ func main() {
 	if len(os.Args) > 4 {
 		configFileCompletePath = os.Args[4]
 	}
+	if os.Getenv("JS_CALCULATIONS_TIMEZONE") != "" {
+		loc, err := time.LoadLocation(os.Getenv("JS_CALCULATIONS_TIMEZONE"))
+		if err != nil {
+			logMain.Error("JS_CALCULATIONS_TIMEZONE environment variable should be a valid time zone name!")
+			os.Exit(2)
+		}
+		defaultTimeZone = loc
+	}
+	if os.Getenv("JS_CALCULATIONS_PLUGINS_DIR") != "" {
+		pluginsDir = os.Getenv("JS_CALCULATIONS_PLUGINS_DIR")
+	}
+	if os.Getenv("JS_CALCULATIONS_PLUGINS_CYCLE_LIMIT") != "" {
+		f, err := strconv.ParseFloat(os.Getenv("JS_CALCULATIONS_PLUGINS_CYCLE_LIMIT"), 64)
+		if err != nil {
+			logMain.Error("JS_CALCULATIONS_PLUGINS_CYCLE_LIMIT environment variable should be a number!")
+			os.Exit(2)
+		}
+		pluginCycleLimit = time.Duration(f * float64(time.Millisecond))
+	}
+
+	setLogLevel(logLevel)
+	tracePoints.Store(parseTraceFilter(os.Getenv("JS_CALCULATIONS_TRACE")))
 
-	log.Println("Instance number: ", instanceNumber)
-	log.Println("Log level: ", logLevel)
-	log.Println("Period of calculation (s): ", periodOfCalculation)
-	log.Println("Config file: ", configFileCompletePath)
+	logMain.Info("Instance number", "instance", instanceNumber)
+	logMain.Info("Log level", "logLevel", logLevel, "format", logFormat)
+	logMain.Info("Period of calculation (s)", "period", periodOfCalculation)
+	logMain.Info("Config file", "file", configFileCompletePath)
+	logMain.Info("Plugins folder", "folder", pluginsDir)
+	logMain.Info("Default time zone", "timeZone", defaultTimeZone.String())
+	logMain.Info("Traced points", "trace", tracePoints.Load().String())
 
 	var cfg config
 	readConfigFile(&cfg)
 	client, collection, err := mongoConnect(cfg)
 	if err != nil {
-		log.Fatal(err)
+		logMain.Error("Error connecting to MongoDB!", "error", err)
+		os.Exit(1)
 	}
 
 	go processRedundancy(cfg)
 
-	calcs := make(map[int]*pointCalc)
-	var nponto int
-
-	projection := bson.D{
-		{Key: "_id", Value: 1},
-		{Key: "formula", Value: 1},
-		{Key: "parcels", Value: 1},
-	}
-	cur, err := collection.Find(context.Background(),
-		bson.D{
-			{Key: "formula", Value: bson.D{
-				{Key: "$gt", Value: 0},
-			}},
-		},
-		options.Find().SetProjection(projection),
-	)
+	calcs, barr, err := loadCalculations(collection)
 	if err != nil {
-		log.Print("find")
-		log.Fatal(err)
-	}
-	for cur.Next(context.Background()) {
-		elem := &realtimeDataForm{}
-		err := cur.Decode(elem)
-		if err != nil {
-			log.Print("decode")
-			log.Print(err)
-			continue
-		}
-
-		nponto = elem.ID
-		calcs[nponto] = &pointCalc{
-			calc:      elem.FORMULA,
-			idParcels: []int{},
-		}
-		calcs[nponto].calc = elem.FORMULA
-		for _, parcel := range elem.PARCELS {
-			calcs[nponto].idParcels = append(calcs[nponto].idParcels, parcel)
-			if logLevel > 1 {
-				log.Printf("%d %d\n", nponto, parcel)
-			}
-		}
+		logCalc.Error("Error loading calculations!", "error", err)
+		os.Exit(1)
 	}
+	order := calcOrder(calcs)
+	go watchCalculationChanges(cfg)
+	plugins := newPluginRegistry(pluginsDir)
 
 	// maps for values and flags of all parcels and calculated points
 	vals := make(map[int]float64)
 	invalids := make(map[int]bool)
 
-	// creates the find array for all parcels
-	barr := bson.A{}
-	for pointnum, p := range calcs {
-		barr = append(barr, pointnum)
-		for _, idparc := range p.idParcels {
-			barr = append(barr, idparc)
-		}
-	}
-
-	projection = bson.D{
+	projection := bson.D{
 		{Key: "_id", Value: 1},
 		{Key: "value", Value: 1},
 		{Key: "invalid", Value: 1},
@@ -444,11 +463,31 @@ func main() {
 		// Check the connection
 		errp := client.Ping(context.TODO(), nil)
 		if errp != nil {
-			log.Printf("%s \n", err)
+			logMain.Error("Disconnected from MongoDB!", "error", errp)
 			client.Disconnect(context.TODO())
 			client, collection, _ = mongoConnect(cfg)
 		}
 
+		// reload calculated points when tags, formulas or parcels changed
+		if reloadCalculations.Swap(false) {
+			c, b, err := loadCalculations(collection)
+			if err != nil {
+				logCalc.Error("Error reloading calculations!", "error", err)
+				reloadCalculations.Store(true)
+			} else {
+				for id, p := range c {
+					if old, ok := calcs[id]; ok {
+						p.keepState(old)
+					}
+				}
+				calcs, barr = c, b
+				order = calcOrder(calcs)
+			}
+		}
+
+		plugins.scan()
+		plugins.beginCycle(periodOfCalculation)
+
 		// find all parcel and current calculated values
 		cur, err := collection.Find(context.Background(),
 			bson.D{
@@ -459,8 +498,8 @@ func main() {
 			options.Find().SetProjection(projection),
 		)
 		if err != nil {
-			log.Print("find")
-			log.Fatal(err)
+			logCalc.Error("Error reading parcels!", "error", err)
+			os.Exit(1)
 		}
 
 		var cntReads = 0
@@ -468,8 +507,7 @@ func main() {
 			elem := &realtimeData{}
 			err := cur.Decode(elem)
 			if err != nil {
-				log.Print("decode")
-				log.Print(err)
+				logCalc.Error("Error decoding parcel!", "error", err)
 				continue
 			}
 
@@ -479,14 +517,25 @@ func main() {
 			// log.Printf("ID %d VAL %f\n", elem.ID, elem.VALUE)
 		}
 
-		log.Printf("Read %v points from MongoDB.\n", cntReads)
+		logCalc.Info("Read points from MongoDB", "count", cntReads)
 
 		cur.Close(context.Background())
 
 		var opers []mongo.WriteModel
 
 		// loop over all calcs
-		for id, p := range calcs {
+		for _, id := range order {
+			p := calcs[id]
+
+			if len(p.unresolved) > 0 { // parcels not found, keep the last value flagged as invalid
+				if isTraced(id, p.tag) {
+					tracePoint(id, p, vals, invalids, vals[id], true, false, !invalids[id])
+				}
+				if !invalids[id] {
+					opers = append(opers, newCalcUpdate(id, vals[id], true, false))
+				}
+				continue
+			}
 
 			ok := false
 			val := 0.0
@@ -494,8 +543,10 @@ func main() {
 			transient := false
 			switch p.calc {
 			default:
-				if logLevel > 1 {
-					log.Println("Formula not available ", p.calc)
+				if plugin := plugins.get(p.calc); plugin != nil { // custom formula from plugin
+					val, invalid, transient, ok = plugin.run(id, p.idParcels, vals, invalids, plugins)
+				} else {
+					logCalc.Log(context.Background(), levelDetailed, "Formula not available", "key", id, "tag", p.tag, "formula", p.calc)
 				}
 			case 1: // CURRENT
 				if len(p.idParcels) == 3 {
@@ -842,6 +893,19 @@ func main() {
 					invalid = invalids[p.idParcels[0]] || invalids[p.idParcels[1]]
 					ok = true
 				}
+			case formulaBalanceCheck: // BALANCE CHECK (P1+P2+...+Pn) - (out parcels), flags imbalance
+				if p.balance != nil {
+					var imbalance bool
+					val, invalid, imbalance = p.balance.evaluate(p.idParcels, vals, invalids, time.Now())
+					if flagOper := p.balance.flagUpdate(imbalance, invalid, vals, invalids); flagOper != nil {
+						opers = append(opers, flagOper)
+					}
+					ok = true
+				}
+			case formulaPeriodActive, formulaPeriodSelect, formulaPeriodCoefficient, formulaPeriodMaximum, formulaPeriodIntegral: // CALENDAR (time period aware)
+				if p.calendar != nil {
+					val, invalid, ok = p.calendar.evaluate(p.calc, vals[id], p.idParcels, vals, invalids, tbegin)
+				}
 			case 200: // P1-P2-P3-P4-P5-P6-P7-P8
 				if len(p.idParcels) == 8 {
 					val = vals[p.idParcels[0]] - vals[p.idParcels[1]] - vals[p.idParcels[2]] - vals[p.idParcels[3]] - vals[p.idParcels[4]] - vals[p.idParcels[5]] - vals[p.idParcels[6]] - vals[p.idParcels[7]]
@@ -1153,32 +1217,16 @@ func main() {
 				}
 			}
 
-			if logLevel > 2 {
-				var chg string
-				if val == vals[id] && invalid == invalids[id] {
-					chg = "NOT_CHANGED"
-				}
-				log.Printf("Key %d Parcels %+v Result %f Invalid %v %s", id, p.idParcels, val, invalid, chg)
+			changed := val != vals[id] || invalid != invalids[id]
+			if isTraced(id, p.tag) {
+				tracePoint(id, p, vals, invalids, val, invalid, ok, changed)
+			} else {
+				logCalc.Debug("Calculated", "key", id, "parcels", p.idParcels, "result", val, "invalid", invalid, "changed", changed)
 			}
 
 			// accumulates updates for changed data
-			if ok && (val != vals[id] || invalid != invalids[id]) {
-				oper := mongo.NewUpdateOneModel()
-				oper.Filter = bson.D{
-					{"_id", id},
-				}
-				oper.Update = bson.D{{
-					"$set", bson.D{{
-						"sourceDataUpdate",
-						bson.D{
-							{"valueAtSource", val},
-							{"invalidAtSource", invalid},
-							{"transientAtSource", transient},
-							{"timeTag", time.Now()},
-						},
-					}},
-				}}
-				opers = append(opers, oper)
+			if ok && changed {
+				opers = append(opers, newCalcUpdate(id, val, invalid, transient))
 			}
 		}
 
@@ -1189,10 +1237,10 @@ func main() {
 				opers,
 			)
 			if res == nil {
-				log.Print("bulk")
-				log.Fatal(err)
+				logCalc.Error("Error writing calculations!", "error", err)
+				os.Exit(1)
 			}
-			log.Printf("Count %d Elapsed %s\n", res.MatchedCount, time.Since(tbegin))
+			logCalc.Info("Calculated points written", "count", res.MatchedCount, "elapsed", time.Since(tbegin).String())
 		}
 
 		// wait for calculation time period to end
@@ -0,0 +1,373 @@
+/*
+ * This process calculates point values based of predefined formulas and configured parcels.
+ * All data is read from and results are written to the MongoDB server.
+ * {json:scada} - Copyright (c) 2020 - 2023 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // embedded time zone database for systems without it (e.g. Windows)
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const calendarsCollectionName = "calendars"
+
+const (
+	formulaPeriodActive      = 57 // 1 when the active period is one of the configured periods
+	formulaPeriodSelect      = 58 // value of the parcel corresponding to the active period
+	formulaPeriodCoefficient = 59 // P1 times the coefficient of the active period
+	formulaPeriodMaximum     = 60 // maximum of P1 since the start of the reset interval
+	formulaPeriodIntegral    = 61 // integral of P1 over time (hours) since the start of the reset interval
+)
+
+var defaultTimeZone *time.Location = time.Local // time zone for calendar formulas when not defined by a calendar
+
+// calendarPeriodForm is a time period of a calendar document
+type calendarPeriodForm struct {
+	Name     string `bson:"name"`
+	Weekdays []int  `bson:"weekdays"` // 0=Sunday...6=Saturday, empty for every day
+	Holidays bool   `bson:"holidays"` // period is also active on holidays
+	Start    string `bson:"start"`    // start time of day as HH:MM (inclusive)
+	End      string `bson:"end"`      // end time of day as HH:MM (exclusive)
+}
+
+// calendarForm is a document of the calendars collection
+type calendarForm struct {
+	Name     string               `bson:"name"`
+	TimeZone string               `bson:"timeZone"`
+	Holidays []string             `bson:"holidays"` // dates as YYYY-MM-DD
+	Periods  []calendarPeriodForm `bson:"periods"`  // evaluated in order, first match is the active period
+}
+
+type calendarPeriod struct {
+	name     string
+	weekdays map[time.Weekday]bool
+	holidays bool
+	start    int // minutes from midnight
+	end      int // minutes from midnight
+}
+
+type calendar struct {
+	name     string
+	loc      *time.Location
+	holidays map[string]bool
+	periods  []calendarPeriod
+}
+
+// calendarCalcForm is the calendar sub-document of a calculated point with a calendar formula
+type calendarCalcForm struct {
+	Name         string             `bson:"name"`         // name of the calendar
+	Periods      []string           `bson:"periods"`      // period names considered by the formula
+	Coefficients map[string]float64 `bson:"coefficients"` // coefficients by period name (formula 59)
+	Reset        string             `bson:"reset"`        // reset interval of accumulators: hour, day, week, month, year or none
+}
+
+// calendarCalc holds the configuration and the accumulator state of a calendar formula
+type calendarCalc struct {
+	cal          *calendar
+	loc          *time.Location
+	periods      []string
+	coefficients map[string]float64
+	reset        string
+	seedValue    float64   // value of the point when loaded
+	seedTime     time.Time // time tag of the point when loaded
+	accValue     float64   // accumulated value
+	accEmpty     bool      // no value accumulated in the interval
+	accStart     time.Time // start of the current reset interval, zero when not initialized
+	accLast      time.Time // time of the last integration
+}
+
+func isCalendarFormula(formula int) bool {
+	return formula >= formulaPeriodActive && formula <= formulaPeriodIntegral
+}
+
+// parses a time of day as HH:MM returning minutes from midnight
+func parseTimeOfDay(s string, def int) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func newCalendar(form *calendarForm) (*calendar, error) {
+	c := &calendar{
+		name:     form.Name,
+		loc:      defaultTimeZone,
+		holidays: make(map[string]bool),
+	}
+	if strings.TrimSpace(form.TimeZone) != "" {
+		loc, err := time.LoadLocation(strings.TrimSpace(form.TimeZone))
+		if err != nil {
+			return nil, err
+		}
+		c.loc = loc
+	}
+	for _, day := range form.Holidays {
+		d, err := time.Parse("2006-01-02", strings.TrimSpace(day))
+		if err != nil {
+			return nil, fmt.Errorf("invalid holiday %q", day)
+		}
+		c.holidays[d.Format("2006-01-02")] = true
+	}
+	for _, pf := range form.Periods {
+		p := calendarPeriod{
+			name:     pf.Name,
+			weekdays: make(map[time.Weekday]bool),
+			holidays: pf.Holidays,
+		}
+		for _, wd := range pf.Weekdays {
+			if wd < 0 || wd > 6 {
+				return nil, fmt.Errorf("period %s: invalid weekday %d", pf.Name, wd)
+			}
+			p.weekdays[time.Weekday(wd)] = true
+		}
+		var err error
+		if p.start, err = parseTimeOfDay(pf.Start, 0); err != nil {
+			return nil, fmt.Errorf("period %s: %v", pf.Name, err)
+		}
+		if p.end, err = parseTimeOfDay(pf.End, 24*60); err != nil {
+			return nil, fmt.Errorf("period %s: %v", pf.Name, err)
+		}
+		c.periods = append(c.periods, p)
+	}
+	return c, nil
+}
+
+// Returns the name of the active period of the calendar, empty when no period is active
+func (c *calendar) activePeriod(now time.Time) string {
+	t := now.In(c.loc)
+	holiday := c.holidays[t.Format("2006-01-02")]
+	minutes := t.Hour()*60 + t.Minute()
+	for _, p := range c.periods {
+		if len(p.weekdays) > 0 {
+			if holiday && !p.holidays {
+				continue
+			}
+			if !holiday && !p.weekdays[t.Weekday()] {
+				continue
+			}
+		}
+		if p.start < p.end {
+			if minutes < p.start || minutes >= p.end {
+				continue
+			}
+		} else if p.start > p.end { // crosses midnight
+			if minutes < p.start && minutes >= p.end {
+				continue
+			}
+		}
+		return p.name
+	}
+	return ""
+}
+
+// Reads all calendars, calendars with invalid configuration are logged and ignored
+func loadCalendars(collection *mongo.Collection) (map[string]*calendar, error) {
+	cals := make(map[string]*calendar)
+	cur, err := collection.Find(context.Background(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(context.Background()) {
+		form := &calendarForm{}
+		if err := cur.Decode(form); err != nil {
+			logCalendar.Error("Error decoding calendar!", "error", err)
+			continue
+		}
+		c, err := newCalendar(form)
+		if err != nil {
+			logCalendar.Error("Invalid calendar!", "calendar", form.Name, "error", err)
+			continue
+		}
+		cals[c.name] = c
+	}
+	return cals, cur.Err()
+}
+
+// reset intervals of accumulators
+var resetIntervals = map[string]bool{"none": true, "hour": true, "day": true, "week": true, "month": true, "year": true}
+
+// Creates the calendar configuration of a calculated point, cal can be nil when not using a calendar.
+// Returns an error for an unknown reset interval.
+func newCalendarCalc(form *calendarCalcForm, cal *calendar, seedValue float64, seedTime time.Time) (*calendarCalc, error) {
+	cc := &calendarCalc{
+		cal:       cal,
+		loc:       defaultTimeZone,
+		reset:     "day",
+		seedValue: seedValue,
+		seedTime:  seedTime,
+		accEmpty:  true,
+	}
+	if cal != nil {
+		cc.loc = cal.loc
+	}
+	if form != nil {
+		cc.periods = form.Periods
+		cc.coefficients = form.Coefficients
+		if strings.TrimSpace(form.Reset) != "" {
+			cc.reset = strings.ToLower(strings.TrimSpace(form.Reset))
+		}
+	}
+	if !resetIntervals[cc.reset] {
+		return nil, fmt.Errorf("unknown reset interval %q", cc.reset)
+	}
+	return cc, nil
+}
+
+// Returns the start of the reset interval containing t
+func (cc *calendarCalc) intervalStart(t time.Time) time.Time {
+	t = t.In(cc.loc)
+	switch cc.reset {
+	case "none":
+		return time.Unix(0, 0)
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, cc.loc)
+	case "week": // weeks start on monday
+		return time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, cc.loc)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, cc.loc)
+	case "year":
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, cc.loc)
+	}
+	// day (reset intervals are validated when loading)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, cc.loc)
+}
+
+// tests if a period is one of the periods considered by the formula (all when none configured)
+func (cc *calendarCalc) inPeriods(period string) bool {
+	if len(cc.periods) == 0 {
+		return true
+	}
+	return cc.periodIndex(period) >= 0
+}
+
+func (cc *calendarCalc) periodIndex(period string) int {
+	for i, p := range cc.periods {
+		if p == period {
+			return i
+		}
+	}
+	return -1
+}
+
+// Evaluates a calendar formula, last is the current value of the calculated point
+func (cc *calendarCalc) evaluate(formula int, last float64, idParcels []int, vals map[int]float64, invalids map[int]bool, now time.Time) (val float64, invalid bool, ok bool) {
+	period := ""
+	if cc.cal != nil {
+		period = cc.cal.activePeriod(now)
+	}
+
+	switch formula {
+	case formulaPeriodActive:
+		if cc.cal == nil {
+			return last, true, true
+		}
+		if period != "" && cc.periodIndex(period) >= 0 {
+			return 1, false, true
+		}
+		return 0, false, true
+
+	case formulaPeriodSelect:
+		idx := cc.periodIndex(period)
+		if period == "" || idx < 0 {
+			idx = len(cc.periods) // a parcel after the ones of the periods is the default
+		}
+		if cc.cal == nil || idx >= len(idParcels) {
+			return last, true, true
+		}
+		return vals[idParcels[idx]], invalids[idParcels[idx]], true
+
+	case formulaPeriodCoefficient:
+		if len(idParcels) != 1 {
+			return 0, true, false
+		}
+		coef, has := cc.coefficients[period]
+		if !has || period == "" {
+			coef, has = cc.coefficients["default"]
+		}
+		if cc.cal == nil || !has {
+			return last, true, true
+		}
+		return vals[idParcels[0]] * coef, invalids[idParcels[0]], true
+
+	case formulaPeriodMaximum, formulaPeriodIntegral:
+		if len(idParcels) != 1 {
+			return 0, true, false
+		}
+		cc.accumulate(formula, vals[idParcels[0]], invalids[idParcels[0]], period, now)
+		return cc.accValue, invalids[idParcels[0]] || (cc.cal == nil && len(cc.periods) > 0), true
+	}
+	return 0, true, false
+}
+
+// updates the accumulator, resetting it at the start of each interval
+func (cc *calendarCalc) accumulate(formula int, value float64, invalid bool, period string, now time.Time) {
+	start := cc.intervalStart(now)
+	if cc.accStart.IsZero() { // first evaluation, continues from the value of the point when updated in the same interval
+		cc.accStart = start
+		cc.accLast = now
+		if !cc.seedTime.IsZero() && !cc.seedTime.Before(start) {
+			cc.accValue = cc.seedValue
+			cc.accEmpty = false
+		}
+	} else if !start.Equal(cc.accStart) { // new interval
+		cc.accStart = start
+		cc.accValue = 0
+		cc.accEmpty = true
+		if cc.accLast.Before(start) {
+			cc.accLast = start
+		}
+	}
+
+	active := !invalid && cc.inPeriods(period) && (cc.cal != nil || len(cc.periods) == 0)
+	switch formula {
+	case formulaPeriodMaximum:
+		if active && (cc.accEmpty || value > cc.accValue) {
+			cc.accValue = value
+			cc.accEmpty = false
+		}
+	case formulaPeriodIntegral:
+		if active && now.After(cc.accLast) {
+			cc.accValue += value * now.Sub(cc.accLast).Hours()
+			cc.accEmpty = false
+		}
+	}
+	cc.accLast = now
+}
+
+// Keeps the accumulator state across reloads
+func (cc *calendarCalc) keepState(old *calendarCalc) {
+	if cc.reset != old.reset || cc.loc.String() != old.loc.String() {
+		return
+	}
+	cc.accValue = old.accValue
+	cc.accEmpty = old.accEmpty
+	cc.accStart = old.accStart
+	cc.accLast = old.accLast
+}
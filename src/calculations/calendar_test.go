@@ -0,0 +1,208 @@
+/*
+ * This process calculates point values based of predefined formulas and configured parcels.
+ * All data is read from and results are written to the MongoDB server.
+ * {json:scada} - Copyright (c) 2020 - 2023 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testCalendar(t *testing.T) *calendar {
+	t.Helper()
+	c, err := newCalendar(&calendarForm{
+		Name:     "tariff",
+		TimeZone: "Europe/Berlin",
+		Holidays: []string{"2026-12-25"},
+		Periods: []calendarPeriodForm{
+			{Name: "peak", Weekdays: []int{1, 2, 3, 4, 5}, Start: "18:00", End: "21:00"},
+			{Name: "night", Start: "22:00", End: "06:00"}, // crosses midnight, every day
+			{Name: "offpeak"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// parses a local time of the calendar zone
+func berlin(t *testing.T, s string) time.Time {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestCalendarActivePeriod(t *testing.T) {
+	c := testCalendar(t)
+	tests := []struct {
+		time   string
+		period string
+	}{
+		{"2026-03-02 18:00", "peak"},    // monday, start inclusive
+		{"2026-03-02 20:59", "peak"},    //
+		{"2026-03-02 21:00", "offpeak"}, // end exclusive
+		{"2026-03-02 22:00", "night"},   // crossing midnight
+		{"2026-03-02 23:59", "night"},   //
+		{"2026-03-03 00:00", "night"},   //
+		{"2026-03-03 05:59", "night"},   //
+		{"2026-03-03 06:00", "offpeak"}, //
+		{"2026-03-07 19:00", "offpeak"}, // saturday
+		{"2026-12-24 19:00", "peak"},    // thursday
+		{"2026-12-25 19:00", "offpeak"}, // friday, holiday
+		{"2026-12-25 23:00", "night"},   // periods without weekdays also on holidays
+		{"2026-03-29 02:30", "night"},   // skipped hour (summer time begins), taken as 03:30
+		{"2026-10-25 02:30", "night"},   // repeated hour
+	}
+	for _, tt := range tests {
+		if period := c.activePeriod(berlin(t, tt.time)); period != tt.period {
+			t.Errorf("%s: %q, want %q", tt.time, period, tt.period)
+		}
+	}
+	// the period is evaluated in the time zone of the calendar
+	if period := c.activePeriod(time.Date(2026, 3, 2, 17, 30, 0, 0, time.UTC)); period != "peak" {
+		t.Errorf("17:30 UTC (18:30 CET): %q, want peak", period)
+	}
+}
+
+func TestCalendarIntervalStart(t *testing.T) {
+	c := testCalendar(t)
+	tests := []struct {
+		reset string
+		time  string
+		start string // UTC
+	}{
+		{"hour", "2026-03-29 10:20", "2026-03-29T08:00:00Z"},
+		{"day", "2026-03-29 10:20", "2026-03-28T23:00:00Z"},  // summer time begins, midnight was CET
+		{"day", "2026-10-25 10:20", "2026-10-24T22:00:00Z"},  // summer time ends, midnight was CEST
+		{"week", "2026-03-29 10:20", "2026-03-22T23:00:00Z"}, // sunday, week starts on monday
+		{"week", "2026-03-30 00:00", "2026-03-29T22:00:00Z"}, // monday
+		{"month", "2026-03-29 10:20", "2026-02-28T23:00:00Z"},
+		{"year", "2026-07-01 10:20", "2025-12-31T23:00:00Z"},
+		{"none", "2026-07-01 10:20", "1970-01-01T00:00:00Z"},
+		{"", "2026-07-01 10:20", "2026-06-30T22:00:00Z"}, // default is day
+	}
+	for _, tt := range tests {
+		cc, err := newCalendarCalc(&calendarCalcForm{Name: "tariff", Reset: tt.reset}, c, 0, time.Time{})
+		if err != nil {
+			t.Fatalf("%q: %v", tt.reset, err)
+		}
+		if start := cc.intervalStart(berlin(t, tt.time)).UTC().Format(time.RFC3339); start != tt.start {
+			t.Errorf("%q %s: %s, want %s", tt.reset, tt.time, start, tt.start)
+		}
+	}
+	if _, err := newCalendarCalc(&calendarCalcForm{Name: "tariff", Reset: "fortnight"}, c, 0, time.Time{}); err == nil {
+		t.Error("unknown reset interval accepted")
+	}
+}
+
+// evaluates a calendar formula every step from begin to end (UTC), returns the values by UTC time
+func runCalendarFormula(t *testing.T, cc *calendarCalc, formula int, value func(time.Time) float64, begin, end time.Time, step time.Duration) map[string]float64 {
+	t.Helper()
+	vals := map[int]float64{}
+	results := map[string]float64{}
+	for now := begin; !now.After(end); now = now.Add(step) {
+		vals[1] = value(now)
+		val, invalid, ok := cc.evaluate(formula, vals[100], []int{1}, vals, nil, now)
+		if !ok || invalid {
+			t.Fatalf("%s: not ok", now)
+		}
+		vals[100] = val
+		results[now.UTC().Format(time.RFC3339)] = val
+	}
+	return results
+}
+
+func TestCalendarIntegralAcrossSummerTime(t *testing.T) {
+	c := testCalendar(t)
+	one := func(time.Time) float64 { return 1 }
+	tests := []struct {
+		name  string
+		begin string // local midnight
+		end   string // UTC, last evaluation before the next local midnight
+		hours float64
+		next  string // UTC, next local midnight
+	}{
+		{"summer time begins", "2026-03-29 00:00", "2026-03-29T21:45:00Z", 22.75, "2026-03-29T22:00:00Z"}, // 23 hours day
+		{"summer time ends", "2026-10-25 00:00", "2026-10-25T22:45:00Z", 24.75, "2026-10-25T23:00:00Z"},   // 25 hours day
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, _ := newCalendarCalc(&calendarCalcForm{Name: "tariff", Reset: "day"}, c, 0, time.Time{})
+			begin := berlin(t, tt.begin)
+			next, _ := time.Parse(time.RFC3339, tt.next)
+			res := runCalendarFormula(t, cc, formulaPeriodIntegral, one, begin, next, 15*time.Minute)
+			if res[tt.end] != tt.hours {
+				t.Errorf("at %s: %v, want %v", tt.end, res[tt.end], tt.hours)
+			}
+			if res[tt.next] != 0 {
+				t.Errorf("at %s (reset): %v, want 0", tt.next, res[tt.next])
+			}
+		})
+	}
+}
+
+func TestCalendarAccumulationAcrossMidnight(t *testing.T) {
+	c := testCalendar(t)
+
+	// integral of the night period (22:00 to 06:00) of each day, each step is credited to the period at its end
+	cc, _ := newCalendarCalc(&calendarCalcForm{Name: "tariff", Periods: []string{"night"}, Reset: "day"}, c, 0, time.Time{})
+	res := runCalendarFormula(t, cc, formulaPeriodIntegral, func(time.Time) float64 { return 2 },
+		berlin(t, "2026-03-02 00:00"), berlin(t, "2026-03-03 00:30"), 30*time.Minute)
+	for _, tt := range []struct {
+		time string
+		want float64
+	}{
+		{"2026-03-02 05:30", 11}, // 00:00 to 05:30
+		{"2026-03-02 06:00", 11}, // 05:30 to 06:00 ends out of the period
+		{"2026-03-02 21:30", 11}, // out of the period
+		{"2026-03-02 23:30", 15}, // 21:30 to 23:30
+		{"2026-03-03 00:00", 0},  // reset at midnight, in the middle of the period
+		{"2026-03-03 00:30", 1},  // the period continues
+	} {
+		if got := res[berlin(t, tt.time).UTC().Format(time.RFC3339)]; got != tt.want {
+			t.Errorf("integral at %s: %v, want %v", tt.time, got, tt.want)
+		}
+	}
+
+	// maximum of the night period across midnight, without reset
+	cc, _ = newCalendarCalc(&calendarCalcForm{Name: "tariff", Periods: []string{"night"}, Reset: "none"}, c, 0, time.Time{})
+	value := func(now time.Time) float64 { return float64(now.In(c.loc).Hour()) }
+	res = runCalendarFormula(t, cc, formulaPeriodMaximum, value, berlin(t, "2026-03-02 21:00"), berlin(t, "2026-03-03 12:00"), time.Hour)
+	for _, tt := range []struct {
+		time string
+		want float64
+	}{
+		{"2026-03-02 21:00", 0},  // out of the period, nothing accumulated
+		{"2026-03-02 23:00", 23}, //
+		{"2026-03-03 05:00", 23}, // lower values after midnight
+		{"2026-03-03 12:00", 23}, // out of the period, hour 12 not considered
+	} {
+		if got := res[berlin(t, tt.time).UTC().Format(time.RFC3339)]; got != tt.want {
+			t.Errorf("maximum at %s: %v, want %v", tt.time, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * This process calculates point values based of predefined formulas and configured parcels.
+ * All data is read from and results are written to the MongoDB server.
+ * {json:scada} - Copyright (c) 2020 - 2023 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// log levels beyond the standard slog levels, mapped from the numeric log level of the process
+const (
+	levelDetailed  = slog.Level(-2)     // log level 2
+	levelDebug     = slog.LevelDebug    // log level 3
+	levelTrace     = slog.LevelInfo + 2 // per-point trace, logged for points in the trace filter at any log level
+	logFormatJSON  = "json"             // value of JS_CALCULATIONS_LOG_FORMAT for JSON output
+	logFormatText  = "text"             // value of JS_CALCULATIONS_LOG_FORMAT for text output (default)
+	traceSeparator = ","                // separator of keys/tags in the trace filter
+)
+
+var logFormat string = logFormatText
+var logLevelVar slog.LevelVar
+
+// loggers by component, replaced by setupLogging
+var (
+	logCalc       = slog.Default().With("component", "calc")
+	logRedundancy = slog.Default().With("component", "redundancy")
+	logPlugins    = slog.Default().With("component", "plugins")
+	logCalendar   = slog.Default().With("component", "calendar")
+	logMain       = slog.Default().With("component", "main")
+)
+
+// traceFilter holds the point keys and tag names of calculated points to be traced
+type traceFilter struct {
+	keys map[int]bool
+	tags map[string]bool
+}
+
+var tracePoints atomic.Pointer[traceFilter]
+
+// Configures the default structured logger with the format (text or json) writing to standard output
+func setupLogging(format string) error {
+	format = strings.ToLower(strings.TrimSpace(format))
+	opts := &slog.HandlerOptions{
+		Level: &logLevelVar,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				switch a.Value.Any().(slog.Level) {
+				case levelDetailed:
+					a.Value = slog.StringValue("DETAILED")
+				case levelTrace:
+					a.Value = slog.StringValue("TRACE")
+				}
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "", logFormatText:
+		logFormat = logFormatText
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	case logFormatJSON:
+		logFormat = logFormatJSON
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger) // messages from the standard log package go to the same handler
+	logCalc = logger.With("component", "calc")
+	logRedundancy = logger.With("component", "redundancy")
+	logPlugins = logger.With("component", "plugins")
+	logCalendar = logger.With("component", "calendar")
+	logMain = logger.With("component", "main")
+	return nil
+}
+
+// Sets the numeric log level of the process (0=minimum,1=basic,2=detailed,3=debug)
+func setLogLevel(level int) {
+	logLevel = level
+	switch {
+	case level <= 1:
+		logLevelVar.Set(slog.LevelInfo)
+	case level == 2:
+		logLevelVar.Set(levelDetailed)
+	default:
+		logLevelVar.Set(levelDebug)
+	}
+}
+
+// Creates a trace filter from point keys or tag names
+func newTraceFilter(refs []interface{}) *traceFilter {
+	f := &traceFilter{keys: make(map[int]bool), tags: make(map[string]bool)}
+	for _, ref := range refs {
+		if key, tag, ok := parcelKey(ref); ok {
+			if tag != "" {
+				f.tags[tag] = true
+			} else {
+				f.keys[key] = true
+			}
+		}
+	}
+	return f
+}
+
+// Parses a list of point keys or tag names separated by commas
+func parseTraceFilter(list string) *traceFilter {
+	var refs []interface{}
+	for _, s := range strings.Split(list, traceSeparator) {
+		if key, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			refs = append(refs, key)
+		} else {
+			refs = append(refs, s)
+		}
+	}
+	return newTraceFilter(refs)
+}
+
+// Tests if the calculated point should be traced
+func isTraced(id int, tag string) bool {
+	f := tracePoints.Load()
+	if f == nil {
+		return false
+	}
+	return f.keys[id] || (tag != "" && f.tags[tag])
+}
+
+// Returns the list of traced points for logging
+func (f *traceFilter) String() string {
+	var list []string
+	for key := range f.keys {
+		list = append(list, strconv.Itoa(key))
+	}
+	for tag := range f.tags {
+		list = append(list, tag)
+	}
+	sort.Strings(list)
+	return strings.Join(list, traceSeparator)
+}
+
+// Logs the evaluation of a traced calculated point with the values and flags of its parcels
+func tracePoint(id int, p *pointCalc, vals map[int]float64, invalids map[int]bool, val float64, invalid bool, ok bool, changed bool) {
+	parcels := make([]slog.Attr, 0, len(p.idParcels))
+	for i, elem := range p.idParcels {
+		parcels = append(parcels, slog.Group("P"+strconv.Itoa(i+1), "key", elem, "value", vals[elem], "invalid", invalids[elem]))
+	}
+	logCalc.LogAttrs(context.Background(), levelTrace, "Point evaluated",
+		slog.Int("key", id),
+		slog.String("tag", p.tag),
+		slog.Int("formula", p.calc),
+		slog.Any("unresolved", p.unresolved),
+		slog.Attr{Key: "parcels", Value: slog.GroupValue(parcels...)},
+		slog.Float64("previous", vals[id]),
+		slog.Float64("result", val),
+		slog.Bool("invalid", invalid),
+		slog.Bool("calculated", ok),
+		slog.Bool("changed", changed),
+	)
+}
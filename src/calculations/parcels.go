@@ -0,0 +1,288 @@
+/*
+ * This process calculates point values based of predefined formulas and configured parcels.
+ * All data is read from and results are written to the MongoDB server.
+ * {json:scada} - Copyright (c) 2020 - 2023 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// set when calculated points or parcel tags change, calculations are reloaded on the next cycle
+var reloadCalculations atomic.Bool
+
+// parcelKey converts a parcel entry to a point key (numeric _id) or to a tag name.
+func parcelKey(v interface{}) (key int, tag string, ok bool) {
+	switch val := v.(type) {
+	case float64:
+		return int(val), "", true
+	case int32:
+		return int(val), "", true
+	case int64:
+		return int(val), "", true
+	case int:
+		return val, "", true
+	case string:
+		tag = strings.TrimSpace(val)
+		return 0, tag, tag != ""
+	}
+	return 0, "", false
+}
+
+// Returns all parcel references of a calculated point, including those from formula specific configuration
+func (elem *realtimeDataForm) parcelRefs() []interface{} {
+	refs := append([]interface{}{}, elem.PARCELS...)
+	if elem.BALANCE != nil {
+		refs = append(refs, elem.BALANCE.OutParcels...)
+		if elem.BALANCE.FlagPoint != nil {
+			refs = append(refs, elem.BALANCE.FlagPoint)
+		}
+	}
+	return refs
+}
+
+// Returns keys of all points read by a calculated point
+func (p *pointCalc) allParcels() []int {
+	keys := append([]int{}, p.idParcels...)
+	if p.balance != nil {
+		keys = append(keys, p.balance.idOutParcels...)
+		if p.balance.idFlag != 0 {
+			keys = append(keys, p.balance.idFlag)
+		}
+	}
+	return keys
+}
+
+// Keeps the state of a calculated point across reloads
+func (p *pointCalc) keepState(old *pointCalc) {
+	if p.calc != old.calc {
+		return
+	}
+	if p.balance != nil && old.balance != nil {
+		p.balance.exceededSince = old.balance.exceededSince
+	}
+	if p.calendar != nil && old.calendar != nil {
+		p.calendar.keepState(old.calendar)
+	}
+}
+
+// Returns the keys of the calculated points in ascending order, the order of evaluation in each cycle
+// (so that the same points are affected when the time budget of the plugins is exceeded)
+func calcOrder(calcs map[int]*pointCalc) []int {
+	keys := make([]int, 0, len(calcs))
+	for id := range calcs {
+		keys = append(keys, id)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Reads calculated points (formula > 0) and resolves parcels referenced by tag name to point keys.
+// Returns the map of calculations and the array of keys of calculated points and parcels to be read each cycle.
+func loadCalculations(collection *mongo.Collection) (calcs map[int]*pointCalc, keys bson.A, err error) {
+	calcs = make(map[int]*pointCalc)
+	keys = bson.A{}
+
+	projection := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "tag", Value: 1},
+		{Key: "formula", Value: 1},
+		{Key: "parcels", Value: 1},
+		{Key: "balanceCheck", Value: 1},
+		{Key: "calendar", Value: 1},
+		{Key: "value", Value: 1},
+		{Key: "timeTag", Value: 1},
+	}
+	cur, err := collection.Find(context.Background(),
+		bson.D{
+			{Key: "formula", Value: bson.D{
+				{Key: "$gt", Value: 0},
+			}},
+		},
+		options.Find().SetProjection(projection),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cur.Close(context.Background())
+
+	var forms []*realtimeDataForm
+	tags := bson.A{}
+	for cur.Next(context.Background()) {
+		elem := &realtimeDataForm{}
+		err := cur.Decode(elem)
+		if err != nil {
+			logCalc.Error("Error decoding calculated point!", "error", err)
+			continue
+		}
+		forms = append(forms, elem)
+		for _, parcel := range elem.parcelRefs() {
+			if _, tag, ok := parcelKey(parcel); ok && tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// find keys of parcels referenced by tag name
+	keyOfTag := make(map[string]int)
+	if len(tags) > 0 {
+		curTags, err := collection.Find(context.Background(),
+			bson.D{
+				{Key: "tag", Value: bson.D{
+					{Key: "$in", Value: tags},
+				}},
+			},
+			options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "tag", Value: 1}}),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		for curTags.Next(context.Background()) {
+			elem := &realtimeDataForm{}
+			if err := curTags.Decode(elem); err != nil {
+				logCalc.Error("Error decoding parcel!", "error", err)
+				continue
+			}
+			keyOfTag[elem.TAG] = elem.ID
+		}
+		curTags.Close(context.Background())
+	}
+
+	cals, err := loadCalendars(collection.Database().Collection(calendarsCollectionName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, elem := range forms {
+		nponto := elem.ID
+		p := &pointCalc{
+			calc:      elem.FORMULA,
+			tag:       elem.TAG,
+			idParcels: []int{},
+		}
+		resolve := func(parcel interface{}) (int, bool) {
+			key, tag, ok := parcelKey(parcel)
+			if !ok {
+				logCalc.Error("Invalid parcel!", "key", nponto, "tag", elem.TAG, "parcel", parcel)
+				p.unresolved = append(p.unresolved, fmt.Sprint(parcel))
+				return 0, false
+			}
+			if tag != "" {
+				if key, ok = keyOfTag[tag]; !ok {
+					logCalc.Error("Parcel tag not found!", "key", nponto, "tag", elem.TAG, "parcel", tag)
+					p.unresolved = append(p.unresolved, tag)
+					return 0, false
+				}
+			}
+			logCalc.Log(context.Background(), levelDetailed, "Parcel", "key", nponto, "parcelKey", key, "parcelTag", tag)
+			return key, true
+		}
+		for _, parcel := range elem.PARCELS {
+			if key, ok := resolve(parcel); ok {
+				p.idParcels = append(p.idParcels, key)
+			}
+		}
+		if elem.FORMULA == formulaBalanceCheck {
+			if elem.BALANCE != nil {
+				p.balance = newBalanceCheck(elem.BALANCE, resolve)
+			} else {
+				logCalc.Error("Balance check without balanceCheck configuration!", "key", nponto, "tag", elem.TAG)
+				p.unresolved = append(p.unresolved, "balanceCheck")
+			}
+		}
+		if isCalendarFormula(elem.FORMULA) {
+			var cal *calendar
+			if elem.CALENDAR != nil && elem.CALENDAR.Name != "" {
+				if cal = cals[elem.CALENDAR.Name]; cal == nil {
+					logCalc.Error("Calendar not found!", "key", nponto, "tag", elem.TAG, "calendar", elem.CALENDAR.Name)
+					p.unresolved = append(p.unresolved, elem.CALENDAR.Name)
+				}
+			}
+			if p.calendar, err = newCalendarCalc(elem.CALENDAR, cal, elem.VALUE, elem.TIMETAG); err != nil {
+				logCalc.Error("Invalid calendar configuration!", "key", nponto, "tag", elem.TAG, "error", err)
+				p.unresolved = append(p.unresolved, err.Error())
+			}
+		}
+
+		calcs[nponto] = p
+		keys = append(keys, nponto)
+		for _, idparc := range p.allParcels() {
+			keys = append(keys, idparc)
+		}
+	}
+
+	logCalc.Info("Loaded calculated points", "count", len(calcs))
+	return calcs, keys, nil
+}
+
+// Watches realtimeData for changes of tag names, formulas and parcels, and the calendars collection.
+// Signals to reload calculations when changes are detected.
+func watchCalculationChanges(cfg config) {
+	pipeline := mongo.Pipeline{bson.D{{Key: "$match", Value: bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "ns.coll", Value: calendarsCollectionName}},
+		bson.D{
+			{Key: "ns.coll", Value: realtimeDataConnectionName},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "operationType", Value: bson.D{{Key: "$in", Value: bson.A{"insert", "delete", "replace"}}}}},
+				bson.D{{Key: "updateDescription.updatedFields.tag", Value: bson.D{{Key: "$exists", Value: true}}}},
+				bson.D{{Key: "updateDescription.updatedFields.formula", Value: bson.D{{Key: "$exists", Value: true}}}},
+				bson.D{{Key: "updateDescription.updatedFields.parcels", Value: bson.D{{Key: "$exists", Value: true}}}},
+				bson.D{{Key: "updateDescription.updatedFields.balanceCheck", Value: bson.D{{Key: "$exists", Value: true}}}},
+				bson.D{{Key: "updateDescription.updatedFields.calendar", Value: bson.D{{Key: "$exists", Value: true}}}},
+			}},
+		},
+	}}}}}}
+
+	for {
+		if mongoClient == nil { // not connected?
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		stream, err := mongoClient.Database(cfg.MongoDatabaseName).Watch(context.Background(), pipeline)
+		if err != nil {
+			logCalc.Error("Error watching realtimeData/calendars changes!", "error", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for stream.Next(context.Background()) {
+			logCalc.Log(context.Background(), levelDetailed, "Change of tags/formulas/parcels/calendars detected, will reload calculations.")
+			reloadCalculations.Store(true)
+		}
+		if err := stream.Err(); err != nil {
+			logCalc.Error("Change stream error!", "error", err)
+		}
+		stream.Close(context.Background())
+
+		// changes could be lost while not watching
+		reloadCalculations.Store(true)
+		time.Sleep(5 * time.Second)
+	}
+}
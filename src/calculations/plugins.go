@@ -0,0 +1,260 @@
+/*
+ * This process calculates point values based of predefined formulas and configured parcels.
+ * All data is read from and results are written to the MongoDB server.
+ * {json:scada} - Copyright (c) 2020 - 2023 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const minPluginFormula = 100000                  // formula numbers above this are reserved for custom usage (plugins)
+const pluginScanPeriod = 10 * time.Second        // period to check for new/changed plugin files
+const pluginLoadTimeout = 1 * time.Second        // max time to run the plugin script when loading
+const defaultPluginCycleLimitFraction = 0.1      // default time budget of all plugins per cycle (fraction of period)
+const pluginInterruptMsg = "time limit exceeded" // reported when a plugin is interrupted
+
+var pluginsDir string = filepath.Join("..", "conf", "calculations-plugins")
+var pluginCycleLimit time.Duration = 0 // max time all plugins together can run in each cycle, zero=use default fraction of period
+
+// formulaPlugin is a custom formula loaded from a JavaScript file named as the formula number (e.g. 100001.js)
+type formulaPlugin struct {
+	formula   int
+	fileName  string
+	modTime   time.Time
+	vm        *goja.Runtime
+	calculate goja.Callable
+}
+
+// pluginRegistry holds the loaded formula plugins
+type pluginRegistry struct {
+	dir      string
+	limit    time.Duration // time budget of all plugins in the cycle
+	used     time.Duration // time used by all plugins in the current cycle
+	exceeded bool          // time budget exceeded in the current cycle
+	plugins  map[int]*formulaPlugin
+	lastScan time.Time
+}
+
+func newPluginRegistry(dir string) *pluginRegistry {
+	return &pluginRegistry{dir: dir, plugins: make(map[int]*formulaPlugin)}
+}
+
+// Loads new or changed plugin files, removes plugins with deleted files. Checks the folder at most every pluginScanPeriod.
+func (r *pluginRegistry) scan() {
+	if time.Since(r.lastScan) < pluginScanPeriod {
+		return
+	}
+	r.lastScan = time.Now()
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		if len(r.plugins) > 0 || !errors.Is(err, os.ErrNotExist) {
+			logPlugins.Error("Error reading folder", "folder", r.dir, "error", err)
+		}
+		return
+	}
+
+	found := make(map[int]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".js" {
+			continue
+		}
+		formula, err := strconv.Atoi(strings.TrimSuffix(name, ".js"))
+		if err != nil || formula <= minPluginFormula {
+			logPlugins.Log(context.Background(), levelDetailed, "Ignoring file, must be named as a formula number over "+strconv.Itoa(minPluginFormula), "file", name)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		found[formula] = true
+		if p, ok := r.plugins[formula]; ok && p.modTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		p, err := loadFormulaPlugin(filepath.Join(r.dir, name), formula, info.ModTime())
+		if err != nil {
+			logPlugins.Error("Error loading formula", "formula", formula, "file", name, "error", err)
+			delete(r.plugins, formula)
+			continue
+		}
+		logPlugins.Info("Loaded formula", "formula", formula, "file", name)
+		r.plugins[formula] = p
+	}
+
+	for formula := range r.plugins {
+		if !found[formula] {
+			logPlugins.Info("Unloaded formula", "formula", formula)
+			delete(r.plugins, formula)
+		}
+	}
+}
+
+// Resets the time budget shared by the plugins, must be called at the beginning of each calculation cycle
+func (r *pluginRegistry) beginCycle(period float64) {
+	r.limit = pluginCycleLimit
+	if r.limit <= 0 {
+		r.limit = time.Duration(period * defaultPluginCycleLimitFraction * float64(time.Second))
+	}
+	r.used = 0
+	r.exceeded = false
+}
+
+// Returns the plugin for a formula, nil if not available
+func (r *pluginRegistry) get(formula int) *formulaPlugin {
+	if formula <= minPluginFormula {
+		return nil
+	}
+	return r.plugins[formula]
+}
+
+func loadFormulaPlugin(fileName string, formula int, modTime time.Time) (*formulaPlugin, error) {
+	src, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := goja.New()
+	vm.Set("log", func(call goja.FunctionCall) goja.Value {
+		args := make([]interface{}, len(call.Arguments))
+		for i, a := range call.Arguments {
+			args[i] = a.Export()
+		}
+		logPlugins.Info(fmt.Sprint(args...), "formula", formula)
+		return goja.Undefined()
+	})
+
+	timer := time.AfterFunc(pluginLoadTimeout, func() { vm.Interrupt(pluginInterruptMsg) })
+	_, err = vm.RunScript(fileName, string(src))
+	timer.Stop()
+	vm.ClearInterrupt()
+	if err != nil {
+		return nil, err
+	}
+
+	calculate, ok := goja.AssertFunction(vm.Get("calculate"))
+	if !ok {
+		return nil, errors.New("function calculate(values, invalids) not defined")
+	}
+
+	return &formulaPlugin{
+		formula:   formula,
+		fileName:  fileName,
+		modTime:   modTime,
+		vm:        vm,
+		calculate: calculate,
+	}, nil
+}
+
+// Runs the plugin over the parcels, the plugin is interrupted when the time budget of all plugins for the cycle is exceeded.
+// Any parcel invalid makes the result invalid unless the plugin returns an object with the invalid property.
+// On errors the last value of the point is kept flagged as invalid.
+func (p *formulaPlugin) run(id int, idParcels []int, vals map[int]float64, invalids map[int]bool, r *pluginRegistry) (val float64, invalid bool, transient bool, ok bool) {
+	if r.exceeded || r.used >= r.limit {
+		r.exceeded = true
+		return vals[id], true, false, true
+	}
+
+	values := make([]interface{}, len(idParcels))
+	flags := make([]interface{}, len(idParcels))
+	for i, elem := range idParcels {
+		values[i] = vals[elem]
+		flags[i] = invalids[elem]
+		invalid = invalid || invalids[elem]
+	}
+
+	tbegin := time.Now()
+	timer := time.AfterFunc(r.limit-r.used, func() { p.vm.Interrupt(pluginInterruptMsg) })
+	res, err := p.call(values, flags)
+	timer.Stop()
+	p.vm.ClearInterrupt()
+	r.used += time.Since(tbegin)
+
+	if err != nil {
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			r.exceeded = true
+			logPlugins.Warn("Time limit of the plugins per cycle exceeded!", "formula", p.formula, "limit", r.limit.String())
+		} else {
+			logPlugins.Log(context.Background(), levelDetailed, "Error running formula", "formula", p.formula, "key", id, "error", err)
+		}
+		return vals[id], true, false, true
+	}
+
+	switch result := res.Export().(type) {
+	case map[string]interface{}:
+		if v, has := result["value"]; has {
+			val = toFloat(v)
+		}
+		if v, has := result["invalid"]; has {
+			invalid, _ = v.(bool)
+		}
+		if v, has := result["transient"]; has {
+			transient, _ = v.(bool)
+		}
+	case bool:
+		if result {
+			val = 1
+		}
+	default:
+		val = toFloat(result)
+	}
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return vals[id], true, transient, true
+	}
+	return val, invalid, transient, true
+}
+
+// calls the plugin function recovering from panics
+func (p *formulaPlugin) call(values []interface{}, flags []interface{}) (res goja.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return p.calculate(goja.Undefined(), p.vm.ToValue(values), p.vm.ToValue(flags))
+}
+
+// converts a value exported from a plugin to float64
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int64:
+		return float64(n)
+	case bool:
+		if n {
+			return 1
+		}
+		return 0
+	}
+	return math.NaN()
+}
@@ -0,0 +1,124 @@
+/*
+ * This process calculates point values based of predefined formulas and configured parcels.
+ * All data is read from and results are written to the MongoDB server.
+ * {json:scada} - Copyright (c) 2020 - 2023 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writes and loads a plugin with the script
+func testPlugin(t *testing.T, formula int, script string) *formulaPlugin {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), strconv.Itoa(formula)+".js")
+	if err := os.WriteFile(fileName, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadFormulaPlugin(fileName, formula, info.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPluginResultConversion(t *testing.T) {
+	vals := map[int]float64{1: 10, 2: 20, 9: 99}
+	tests := []struct {
+		name      string
+		body      string
+		invalids  map[int]bool
+		val       float64
+		invalid   bool
+		transient bool
+	}{
+		{"number", "return values[0] + values[1];", nil, 30, false, false},
+		{"integer", "return 7;", nil, 7, false, false},
+		{"true", "return true;", nil, 1, false, false},
+		{"false", "return false;", nil, 0, false, false},
+		{"object", "return { value: 5, transient: true };", nil, 5, false, true},
+		{"object invalid", "return { value: 5, invalid: true };", nil, 5, true, false},
+		{"invalid parcel", "return values[0];", map[int]bool{2: true}, 10, true, false},
+		{"invalid parcel overridden", "return { value: values[0], invalid: false };", map[int]bool{2: true}, 10, false, false},
+		{"string keeps last value", "return 'x';", nil, 99, true, false},
+		{"infinity keeps last value", "return 1 / 0;", nil, 99, true, false},
+		{"error keeps last value", "throw new Error('bad');", nil, 99, true, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPlugin(t, minPluginFormula+1+i, "function calculate(values, invalids) { "+tt.body+" }")
+			r := &pluginRegistry{limit: time.Second}
+			val, invalid, transient, ok := p.run(9, []int{1, 2}, vals, tt.invalids, r)
+			if !ok || val != tt.val || invalid != tt.invalid || transient != tt.transient {
+				t.Errorf("got %v %v %v %v, want %v %v %v", val, invalid, transient, ok, tt.val, tt.invalid, tt.transient)
+			}
+		})
+	}
+}
+
+func TestPluginCycleBudget(t *testing.T) {
+	vals := map[int]float64{1: 1, 8: 88, 9: 99}
+	slow := testPlugin(t, minPluginFormula+1, "function calculate(values) { for (;;) {} }")
+	fast := testPlugin(t, minPluginFormula+2, "function calculate(values) { return 42; }")
+	r := &pluginRegistry{plugins: map[int]*formulaPlugin{}}
+	r.beginCycle(1)
+	r.limit = 50 * time.Millisecond
+
+	tbegin := time.Now()
+	val, invalid, _, _ := slow.run(9, []int{1}, vals, nil, r)
+	if elapsed := time.Since(tbegin); elapsed > time.Second {
+		t.Fatalf("plugin interrupted after %s", elapsed)
+	}
+	if val != 99 || !invalid || !r.exceeded {
+		t.Fatalf("slow plugin: got %v %v, exceeded %v", val, invalid, r.exceeded)
+	}
+
+	// the budget is shared, other plugins are not run in the rest of the cycle
+	if val, invalid, _, _ := fast.run(8, []int{1}, vals, nil, r); val != 88 || !invalid {
+		t.Fatalf("plugin run after the budget was exceeded: got %v %v", val, invalid)
+	}
+
+	// renewed on the next cycle
+	r.beginCycle(1)
+	if val, invalid, _, _ := fast.run(8, []int{1}, vals, nil, r); val != 42 || invalid {
+		t.Fatalf("next cycle: got %v %v", val, invalid)
+	}
+	if r.used <= 0 || r.used > r.limit {
+		t.Fatalf("time used %s of %s", r.used, r.limit)
+	}
+}
+
+func TestCalcOrder(t *testing.T) {
+	calcs := map[int]*pointCalc{30: {}, 10: {}, 20: {}, 5: {}}
+	for i := 0; i < 10; i++ {
+		order := calcOrder(calcs)
+		for j := 1; j < len(order); j++ {
+			if order[j-1] >= order[j] {
+				t.Fatalf("order %v not ascending", order)
+			}
+		}
+	}
+}
@@ -1214,12 +1214,15 @@ const pipeline = [
                   )
 
                 // prepare update to soeData collection, do not put into SOE when alarm disabled or update is not for historical record
+                // also skip when the protocol driver already recorded the event
                 if (
                   isSOE &&
                   change.fullDocument.type !== 'analog' &&
                   !change.fullDocument.alarmDisabled &&
                   !change.updateDescription.updatedFields.sourceDataUpdate
-                    ?.isNotForHistorical
+                    ?.isNotForHistorical &&
+                  !change.updateDescription.updatedFields.sourceDataUpdate
+                    ?.soeRecorded
                 )
                   if (!(value === 0 && change.fullDocument.isEvent)) {
                     let eventText = change.fullDocument.eventTextFalse
@@ -0,0 +1,136 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Authenticated datagrams have a trailer with a sequence number and a HMAC-SHA256 of the datagram and the sequence number:
+//
+//	datagram + uint64 sequence number (little endian) + 32 bytes HMAC-SHA256(secret, datagram + sequence number)
+//
+// The sequence number is the time of the sender in Unix nanoseconds (increased by one when the clock does not advance),
+// so that it keeps increasing after restarts and old datagrams can be rejected.
+const (
+	authTrailerSize = 8 + sha256.Size
+	authMaxSkew     = 60 * time.Second // maximum difference of the sequence number (sender time) to the local time
+)
+
+// errors of datagram authentication
+var (
+	errAuthMissing = errors.New("authentication trailer missing")
+	errAuthBadMAC  = errors.New("invalid message authentication code")
+	errAuthSkew    = errors.New("sequence number out of time window")
+	errAuthReplay  = errors.New("replayed sequence number")
+)
+
+// authState keeps the sequence numbers of a connection with authentication
+type authState struct {
+	mu      sync.Mutex
+	lastSeq uint64                 // last sequence number sent
+	seen    map[authSeen]time.Time // datagrams received in the time window, from any source
+	pruned  time.Time
+}
+
+// a sequence number and code received, a replay has both equal whatever the source address
+type authSeen struct {
+	seq uint64
+	mac [sha256.Size]byte
+}
+
+func (protCon *protocolConnection) authEnabled() bool {
+	return protCon.AuthSecret != ""
+}
+
+func (protCon *protocolConnection) authMAC(buf []byte, seq []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(protCon.AuthSecret))
+	mac.Write(buf)
+	mac.Write(seq)
+	return mac.Sum(nil)
+}
+
+// Appends the authentication trailer to a datagram to be sent, returns the datagram unchanged when authentication is disabled
+func (protCon *protocolConnection) sign(buf []byte) []byte {
+	if !protCon.authEnabled() {
+		return buf
+	}
+	a := protCon.auth
+	a.mu.Lock()
+	seq := uint64(time.Now().UnixNano())
+	if seq <= a.lastSeq {
+		seq = a.lastSeq + 1
+	}
+	a.lastSeq = seq
+	a.mu.Unlock()
+
+	out := make([]byte, len(buf), len(buf)+authTrailerSize)
+	copy(out, buf)
+	out = binary.LittleEndian.AppendUint64(out, seq)
+	return append(out, protCon.authMAC(buf, out[len(buf):])...)
+}
+
+// Checks the authentication trailer of a datagram received, returns the datagram without the trailer.
+// Returns the datagram unchanged when authentication is disabled.
+func (protCon *protocolConnection) verify(buf []byte, t time.Time) ([]byte, error) {
+	if !protCon.authEnabled() {
+		return buf, nil
+	}
+	if len(buf) < authTrailerSize+4 {
+		return nil, fmt.Errorf("%w: %d bytes", errAuthMissing, len(buf))
+	}
+	data := buf[:len(buf)-authTrailerSize]
+	seqBytes := buf[len(data) : len(data)+8]
+	if !hmac.Equal(buf[len(data)+8:], protCon.authMAC(data, seqBytes)) {
+		return nil, errAuthBadMAC
+	}
+	seq := binary.LittleEndian.Uint64(seqBytes)
+	senderTime := time.Unix(0, int64(seq))
+	if skew := t.Sub(senderTime); skew > authMaxSkew || skew < -authMaxSkew {
+		return nil, fmt.Errorf("%w: %s", errAuthSkew, skew.Round(time.Millisecond))
+	}
+
+	a := protCon.auth
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seen == nil {
+		a.seen = make(map[authSeen]time.Time)
+	}
+	if t.Sub(a.pruned) > time.Second { // forget sequence numbers that can not be accepted anymore
+		for k, st := range a.seen {
+			if t.Sub(st) > authMaxSkew {
+				delete(a.seen, k)
+			}
+		}
+		a.pruned = t
+	}
+	key := authSeen{seq: seq}
+	copy(key.mac[:], buf[len(data)+8:])
+	if _, found := a.seen[key]; found {
+		return nil, fmt.Errorf("%w: %d", errAuthReplay, seq)
+	}
+	a.seen[key] = senderTime
+	return data, nil
+}
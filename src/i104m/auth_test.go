@@ -0,0 +1,92 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	sender := &protocolConnection{AuthSecret: "secret", auth: &authState{}}
+	data := []byte{0x53, 0x64, 0x13, 0x00, 0x01, 0x00, 0x00, 0x00}
+	signed := sender.sign(data)
+	if len(signed) != len(data)+authTrailerSize {
+		t.Fatalf("signed length %d, want %d", len(signed), len(data)+authTrailerSize)
+	}
+	tampered := bytes.Clone(signed)
+	tampered[4] ^= 1
+	otherKey := (&protocolConnection{AuthSecret: "other", auth: &authState{}}).sign(data)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		packet []byte
+		at     time.Time
+		err    error
+	}{
+		{"valid", signed, now, nil},
+		{"same source replay", signed, now, errAuthReplay},
+		{"cross source replay", signed, now.Add(time.Second), errAuthReplay},
+		{"second datagram", sender.sign(data), now, nil},
+		{"tampered data", tampered, now, errAuthBadMAC},
+		{"other secret", otherKey, now, errAuthBadMAC},
+		{"missing trailer", data, now, errAuthMissing},
+		{"truncated trailer", signed[:len(signed)-1], now, errAuthBadMAC},
+		{"sender ahead", sender.sign(data), now.Add(-authMaxSkew - time.Second), errAuthSkew},
+		{"sender behind", sender.sign(data), now.Add(authMaxSkew + time.Second), errAuthSkew},
+	}
+	receiver := &protocolConnection{AuthSecret: "secret", auth: &authState{}}
+	for _, tt := range tests {
+		got, err := receiver.verify(tt.packet, tt.at)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(got, data) {
+			t.Errorf("%s: data % x, want % x", tt.name, got, data)
+		}
+	}
+}
+
+func TestVerifyDisabled(t *testing.T) {
+	pc := &protocolConnection{auth: &authState{}}
+	data := []byte{0x53, 0x64, 0x13, 0x00, 0x01}
+	if got := pc.sign(data); !bytes.Equal(got, data) {
+		t.Errorf("sign changed the datagram: % x", got)
+	}
+	if got, err := pc.verify(data, time.Now()); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("verify: % x, %v", got, err)
+	}
+}
+
+func TestVerifyPrunesSeen(t *testing.T) {
+	now := time.Now()
+	pc := &protocolConnection{AuthSecret: "secret", auth: &authState{
+		seen: map[authSeen]time.Time{{seq: 1}: now.Add(-authMaxSkew - time.Second)}, // can not be accepted anymore
+	}}
+	if _, err := pc.verify(pc.sign([]byte{1, 2, 3, 4, 5}), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := pc.auth.seen[authSeen{seq: 1}]; found || len(pc.auth.seen) != 1 {
+		t.Errorf("seen %v, want only the last datagram", pc.auth.seen)
+	}
+}
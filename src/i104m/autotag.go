@@ -0,0 +1,230 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// realtimeData document of tags created automatically
+type RtDataTag struct {
+	Id                             float64   `bson:"_id" json:"_id"`
+	ProtocolSourceASDU             string    `bson:"protocolSourceASDU" json:"protocolSourceASDU"`
+	ProtocolSourceCommonAddress    float64   `bson:"protocolSourceCommonAddress" json:"protocolSourceCommonAddress"`
+	ProtocolSourceConnectionNumber float64   `bson:"protocolSourceConnectionNumber" json:"protocolSourceConnectionNumber"`
+	ProtocolSourceObjectAddress    float64   `bson:"protocolSourceObjectAddress" json:"protocolSourceObjectAddress"`
+	ProtocolSourceCommandUseSBO    bool      `bson:"protocolSourceCommandUseSBO" json:"protocolSourceCommandUseSBO"`
+	ProtocolSourceCommandDuration  float64   `bson:"protocolSourceCommandDuration" json:"protocolSourceCommandDuration"`
+	AlarmState                     float64   `bson:"alarmState" json:"alarmState"`
+	AlarmRange                     float64   `bson:"alarmRange" json:"alarmRange"`
+	Description                    string    `bson:"description" json:"description"`
+	UngroupedDescription           string    `bson:"ungroupedDescription" json:"ungroupedDescription"`
+	Group1                         string    `bson:"group1" json:"group1"`
+	Group2                         string    `bson:"group2" json:"group2"`
+	Group3                         string    `bson:"group3" json:"group3"`
+	StateTextFalse                 string    `bson:"stateTextFalse" json:"stateTextFalse"`
+	StateTextTrue                  string    `bson:"stateTextTrue" json:"stateTextTrue"`
+	EventTextFalse                 string    `bson:"eventTextFalse" json:"eventTextFalse"`
+	EventTextTrue                  string    `bson:"eventTextTrue" json:"eventTextTrue"`
+	Origin                         string    `bson:"origin" json:"origin"`
+	Tag                            string    `bson:"tag" json:"tag"`
+	Type                           string    `bson:"type" json:"type"`
+	Value                          float64   `bson:"value" json:"value"`
+	ValueString                    string    `bson:"valueString" json:"valueString"`
+	ValueJson                      bson.M    `bson:"valueJson" json:"valueJson"`
+	AlarmDisabled                  bool      `bson:"alarmDisabled" json:"alarmDisabled"`
+	Alerted                        bool      `bson:"alerted" json:"alerted"`
+	Alarmed                        bool      `bson:"alarmed" json:"alarmed"`
+	Annotation                     string    `bson:"annotation" json:"annotation"`
+	CommandBlocked                 bool      `bson:"commandBlocked" json:"commandBlocked"`
+	CommandOfSupervised            float64   `bson:"commandOfSupervised" json:"commandOfSupervised"`
+	CommissioningRemarks           string    `bson:"commissioningRemarks" json:"commissioningRemarks"`
+	Formula                        float64   `bson:"formula" json:"formula"`
+	Frozen                         bool      `bson:"frozen" json:"frozen"`
+	FrozenDetectTimeout            float64   `bson:"frozenDetectTimeout" json:"frozenDetectTimeout"`
+	HiLimit                        float64   `bson:"hiLimit" json:"hiLimit"`
+	HihiLimit                      float64   `bson:"hihiLimit" json:"hihiLimit"`
+	HihihiLimit                    float64   `bson:"hihihiLimit" json:"hihihiLimit"`
+	HistorianDeadBand              float64   `bson:"historianDeadBand" json:"historianDeadBand"`
+	HistorianPeriod                float64   `bson:"historianPeriod" json:"historianPeriod"`
+	Hysteresis                     float64   `bson:"hysteresis" json:"hysteresis"`
+	Invalid                        bool      `bson:"invalid" json:"invalid"`
+	InvalidDetectTimeout           float64   `bson:"invalidDetectTimeout" json:"invalidDetectTimeout"`
+	IsEvent                        bool      `bson:"isEvent" json:"isEvent"`
+	Kconv1                         float64   `bson:"kconv1" json:"kconv1"`
+	Kconv2                         float64   `bson:"kconv2" json:"kconv2"`
+	Location                       bson.M    `bson:"location" json:"location"`
+	LoLimit                        float64   `bson:"loLimit" json:"loLimit"`
+	LoloLimit                      float64   `bson:"loloLimit" json:"loloLimit"`
+	LololoLimit                    float64   `bson:"lololoLimit" json:"lololoLimit"`
+	Notes                          string    `bson:"notes" json:"notes"`
+	Overflow                       bool      `bson:"overflow" json:"overflow"`
+	Parcels                        []float64 `bson:"parcels" json:"parcels"`
+	Priority                       float64   `bson:"priority" json:"priority"`
+	ProtocolDestinations           bson.A    `bson:"protocolDestinations" json:"protocolDestinations"`
+	SourceDataUpdate               bson.M    `bson:"sourceDataUpdate" json:"sourceDataUpdate"`
+	SupervisedOfCommand            float64   `bson:"supervisedOfCommand" json:"supervisedOfCommand"`
+	Substituted                    bool      `bson:"substituted" json:"substituted"`
+	TimeTag                        time.Time `bson:"timeTag" json:"timeTag"`
+	TimeTagAlarm                   time.Time `bson:"timeTagAlarm" json:"timeTagAlarm"`
+	TimeTagAtSource                time.Time `bson:"timeTagAtSource" json:"timeTagAtSource"`
+	TimeTagAtSourceOk              bool      `bson:"timeTagAtSourceOk" json:"timeTagAtSourceOk"`
+	Transient                      bool      `bson:"transient" json:"transient"`
+	Unit                           string    `bson:"unit" json:"unit"`
+	UpdatesCnt                     float64   `bson:"updatesCnt" json:"updatesCnt"`
+	ValueDefault                   float64   `bson:"valueDefault" json:"valueDefault"`
+	ZeroDeadband                   float64   `bson:"zeroDeadband" json:"zeroDeadband"`
+}
+
+const autoKeyMultiplier = 1000000 // should be more than estimated maximum points on a connection
+
+var listCreatedTags = map[string]string{} // tags already created or found, with the type
+
+// Returns a new tag with the default values
+func NewRtDataTag() RtDataTag {
+	return RtDataTag{
+		AlarmState:  -1,
+		Origin:      "supervised",
+		Type:        "analog",
+		HiLimit:     math.MaxFloat64,
+		HihiLimit:   math.MaxFloat64,
+		HihihiLimit: math.MaxFloat64,
+		LoLimit:     -math.MaxFloat64,
+		LoloLimit:   -math.MaxFloat64,
+		LololoLimit: -math.MaxFloat64,
+		Kconv1:      1,
+	}
+}
+
+// Returns the type of the tag created for the ASDU type
+func autoTagType(iecAsdu uint32) string {
+	switch iecAsdu {
+	case 1, 2, 3, 4, 30, 31, 17, 38: // single, double points and protection events
+		return "digital"
+	}
+	return "analog"
+}
+
+// Finds the highest key of the tags created for the connection, keys are numbered from connectionNumber * autoKeyMultiplier
+func (pc *protocolConnection) GetAutoKeyInitialValueConn(collectionRtData *mongo.Collection) int {
+	pc.autoKeyId = pc.ProtocolConnectionNumber * autoKeyMultiplier
+
+	filter := bson.D{
+		{Key: "_id", Value: bson.D{
+			{Key: "$gt", Value: pc.autoKeyId},
+			{Key: "$lt", Value: (pc.ProtocolConnectionNumber + 1) * autoKeyMultiplier},
+		}},
+	}
+	var res bson.M
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})
+	if err := collectionRtData.FindOne(context.TODO(), filter, opts).Decode(&res); err == nil {
+		if v, ok := res["_id"].(float64); ok && v > float64(pc.autoKeyId) {
+			pc.autoKeyId = int(v)
+		}
+	}
+	return pc.autoKeyId
+}
+
+// Creates a tag for an object address received when not found in realtimeData
+func (pc *protocolConnection) AutoCreateTag(commonAddress uint32, objAddr uint32, iecAsdu uint32, rtDataCollection *mongo.Collection) {
+	tag := fmt.Sprintf("%s.%d.%d", driverName, pc.ProtocolConnectionNumber, objAddr)
+	if pc.MapCommonAddress {
+		tag = fmt.Sprintf("%s.%d.%d.%d", driverName, pc.ProtocolConnectionNumber, commonAddress, objAddr)
+	}
+	if _, ok := listCreatedTags[tag]; ok { // if already in the created list, just returns
+		return
+	}
+
+	// not in the list, so try to find it, will create a new tag if not found
+	var res bson.M
+	err := rtDataCollection.FindOne(context.TODO(), pc.sourceFilter(commonAddress, objAddr)).Decode(&res)
+	if err == nil {
+		typ, _ := res["type"].(string)
+		listCreatedTags[tag] = typ
+		return
+	}
+	if err != mongo.ErrNoDocuments {
+		log.Println("Mongodb: error searching tag -", tag, err)
+		return
+	}
+
+	rtData := NewRtDataTag()
+	rtData.Tag = tag
+	rtData.Type = autoTagType(iecAsdu)
+	rtData.ProtocolSourceConnectionNumber = float64(pc.ProtocolConnectionNumber)
+	rtData.ProtocolSourceObjectAddress = float64(objAddr)
+	rtData.ProtocolSourceCommonAddress = float64(commonAddress)
+	rtData.ProtocolSourceASDU = fmt.Sprintf("%d", iecAsdu)
+	rtData.Group1 = driverName
+	rtData.Group2 = pc.Name
+	rtData.Group3 = fmt.Sprintf("%d", objAddr)
+	rtData.Description = tag
+	rtData.UngroupedDescription = fmt.Sprintf("%d", objAddr)
+	rtData.EventTextFalse = "OFF"
+	rtData.EventTextTrue = "ON"
+	rtData.StateTextFalse = "OFF"
+	rtData.StateTextTrue = "ON"
+	rtData.TimeTag = time.Now()
+
+	for {
+		// not found, so insert a new tag
+		pc.autoKeyId++
+		rtData.Id = float64(pc.autoKeyId)
+		if _, err = rtDataCollection.InsertOne(context.TODO(), rtData); err == nil { // insert ok: finish loop
+			log.Println("Mongodb: new tag inserted -", rtData.Tag, rtData.Id)
+			break
+		}
+
+		if strings.Contains(err.Error(), "E11000") && strings.Contains(err.Error(), "_id:") { // duplicate _id error, inc _id
+			log.Println("Mongodb: duplicated _id while inserting new tag -", rtData.Tag, rtData.Id)
+			continue
+		}
+
+		if strings.Contains(err.Error(), "E11000") && strings.Contains(err.Error(), "tag:") { // duplicate tag error
+			log.Println("Mongodb: duplicated tag while inserting new tag -", rtData.Tag, rtData.Id)
+			// existing tag, update it (object address)
+			if _, err = rtDataCollection.UpdateOne(context.TODO(),
+				bson.D{{Key: "tag", Value: rtData.Tag}},
+				bson.D{{Key: "$set", Value: bson.D{
+					{Key: "protocolSourceConnectionNumber", Value: rtData.ProtocolSourceConnectionNumber},
+					{Key: "protocolSourceObjectAddress", Value: rtData.ProtocolSourceObjectAddress},
+					{Key: "protocolSourceCommonAddress", Value: rtData.ProtocolSourceCommonAddress},
+					{Key: "protocolSourceASDU", Value: rtData.ProtocolSourceASDU},
+				}}}); err != nil {
+				log.Println("Mongodb: Error updating tag -", rtData.Tag, err)
+				return
+			}
+			log.Println("Mongodb: updated tag -", rtData.Tag, "protocolSourceObjectAddress=", objAddr)
+			break
+		}
+		// some other error: give up creating tag
+		log.Println("Mongodb: error while inserting new tag -", rtData.Tag, rtData.Id, err)
+		return
+	}
+	listCreatedTags[tag] = rtData.Type
+}
@@ -0,0 +1,266 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Capture file format (little endian):
+//
+//	header: "I104MCAP" + uint16 version
+//	record: int64 receive time (unix ns) + uint8 source length + source address + uint16 data length + datagram
+const (
+	captureMagic   = "I104MCAP"
+	captureVersion = 1
+)
+
+var errInvalidCapture = errors.New("invalid capture file")
+
+// captured datagram
+type captureRecord struct {
+	time   time.Time
+	source string // IP:port of origin
+	data   []byte
+}
+
+// captureWriter appends received datagrams to a capture file, safe for use by concurrent listeners
+type captureWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+var capture *captureWriter // nil when capture is disabled
+
+// Creates the capture file (truncated if exists) and writes the header
+func newCaptureWriter(fileName string) (*captureWriter, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	c := &captureWriter{file: file, w: bufio.NewWriter(file)}
+	c.w.WriteString(captureMagic)
+	binary.Write(c.w, binary.LittleEndian, uint16(captureVersion))
+	if err = c.w.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Writes a datagram received to the capture file
+func (c *captureWriter) write(t time.Time, source string, data []byte) {
+	if len(source) > 255 {
+		source = source[:255]
+	}
+	if len(data) > 65535 {
+		data = data[:65535]
+	}
+	rec := make([]byte, 0, 8+1+len(source)+2+len(data))
+	rec = binary.LittleEndian.AppendUint64(rec, uint64(t.UnixNano()))
+	rec = append(rec, byte(len(source)))
+	rec = append(rec, source...)
+	rec = binary.LittleEndian.AppendUint16(rec, uint16(len(data)))
+	rec = append(rec, data...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.Write(rec)
+	if err := c.w.Flush(); err != nil { // flush every record to not lose data when the driver is stopped
+		log.Printf("Capture - Error writing file: %v", err)
+	}
+}
+
+func (c *captureWriter) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.Flush()
+	return c.file.Close()
+}
+
+// Reads the capture file header, returns a reader positioned on the first record
+func openCapture(r io.Reader) (*bufio.Reader, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(captureMagic)+2)
+	if _, err := io.ReadFull(br, hdr); err != nil || string(hdr[:len(captureMagic)]) != captureMagic {
+		return nil, errInvalidCapture
+	}
+	if v := binary.LittleEndian.Uint16(hdr[len(captureMagic):]); v != captureVersion {
+		return nil, fmt.Errorf("%w: version %d", errInvalidCapture, v)
+	}
+	return br, nil
+}
+
+// Reads the next record of a capture, returns io.EOF at the end of the file
+func readCaptureRecord(br *bufio.Reader) (*captureRecord, error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated record", errInvalidCapture)
+		}
+		return nil, err
+	}
+	rec := &captureRecord{time: time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[0:])))}
+	src := make([]byte, hdr[8])
+	var size [2]byte
+	if _, err := io.ReadFull(br, src); err != nil {
+		return nil, fmt.Errorf("%w: truncated record", errInvalidCapture)
+	}
+	if _, err := io.ReadFull(br, size[:]); err != nil {
+		return nil, fmt.Errorf("%w: truncated record", errInvalidCapture)
+	}
+	rec.source = string(src)
+	rec.data = make([]byte, binary.LittleEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(br, rec.data); err != nil {
+		return nil, fmt.Errorf("%w: truncated record", errInvalidCapture)
+	}
+	return rec, nil
+}
+
+// Sends the datagrams of a capture file to the destination address.
+// Speed 1 keeps the original timing, greater values accelerate (e.g. 10 = ten times faster), 0 sends as fast as possible.
+func replayCapture(fileName string, destination string, speed float64) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	br, err := openCapture(file)
+	if err != nil {
+		return err
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", destination)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var first time.Time
+	start := time.Now()
+	cnt := 0
+	for {
+		rec, err := readCaptureRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if cnt == 0 {
+			first = rec.time
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(rec.time.Sub(first)) / speed))
+			time.Sleep(time.Until(due))
+		}
+		if _, err = conn.Write(rec.data); err != nil {
+			return err
+		}
+		cnt++
+		if logLevel >= logLevelDetailed {
+			log.Printf("Replay - Sent %d bytes captured from %s at %s, #%d", len(rec.data), rec.source, rec.time.Format(time.RFC3339Nano), cnt)
+		}
+	}
+	log.Printf("Replay - %d datagrams sent to %s in %s.", cnt, destination, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Prints the records of a capture file with the packets decoded
+func dumpCapture(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	br, err := openCapture(file)
+	if err != nil {
+		return err
+	}
+	for cnt := 1; ; cnt++ {
+		rec, err := readCaptureRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var desc string
+		pkt, errPkt := decodeI104MPacket(rec.data)
+		cmd, errCmd := decodeI104MCommand(rec.data)
+		switch {
+		case errPkt == nil:
+			desc = fmt.Sprintf("ASDU %d CA %d cause %d objects %d", pkt.asdu, pkt.commonAddress, pkt.cause, len(pkt.objects))
+		case errCmd == nil:
+			desc = fmt.Sprintf("command ASDU %d CA %d address %d value %d", cmd.asdu, cmd.commonAddress, cmd.objectAddress, cmd.value)
+		default:
+			desc = "invalid: " + errPkt.Error()
+		}
+		fmt.Printf("#%d %s %s %d bytes %s\n", cnt, rec.time.Format(time.RFC3339Nano), rec.source, len(rec.data), desc)
+	}
+}
+
+// Runs the replay and dump tools: i104m replay <capture file> <destination IP:port> [speed], i104m dump <capture file>.
+// Returns false when the arguments are not a tool command.
+func runCaptureTool(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	var err error
+	switch args[1] {
+	case "replay":
+		if len(args) < 4 {
+			log.Println("Usage i104m replay [capture file] [destination IP:port] [speed (1=original, 0=max)]")
+			os.Exit(2)
+		}
+		speed := 1.0
+		if len(args) > 4 {
+			if speed, err = strconv.ParseFloat(args[4], 64); err != nil || speed < 0 {
+				log.Println("Speed parameter should be a non negative number!")
+				os.Exit(2)
+			}
+		}
+		err = replayCapture(args[2], args[3], speed)
+	case "dump":
+		if len(args) < 3 {
+			log.Println("Usage i104m dump [capture file]")
+			os.Exit(2)
+		}
+		err = dumpCapture(args[2])
+	default:
+		return false
+	}
+	checkFatalError(err)
+	return true
+}
@@ -0,0 +1,218 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// capture file written by the capture writer with packets in the OSHMI format: interrogation, spontaneous changes
+// (with a copy from a redundant source) and a command (received from a client) with its confirmations
+const testCaptureFile = "testdata/oshmi.cap"
+
+func testCaptureRecords(t *testing.T) []captureRecord {
+	t.Helper()
+	t0 := time.Date(2025, time.March, 15, 12, 30, 15, 123456789, time.UTC)
+	return []captureRecord{
+		{t0, "192.168.0.10:8098", mustHex(t, pktConfirmationGI)},
+		{t0.Add(30 * time.Millisecond), "192.168.0.10:8098", mustHex(t, pktSequenceFloat)},
+		{t0.Add(30 * time.Millisecond), "[fe80::1]:8098", mustHex(t, pktSingleSPTB)}, // same time
+		{t0.Add(90 * time.Millisecond), "192.168.0.20:51000", mustHex(t, pktCommandSingle)},
+		{t0.Add(100 * time.Millisecond), "", []byte{}},
+	}
+}
+
+func readCaptureFile(t testing.TB, fileName string) []captureRecord {
+	t.Helper()
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	br, err := openCapture(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []captureRecord
+	for {
+		rec, err := readCaptureRecord(br)
+		if err == io.EOF {
+			return recs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, *rec)
+	}
+}
+
+func writeCaptureFile(t *testing.T, recs []captureRecord) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "test.cap")
+	c, err := newCaptureWriter(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		c.write(rec.time, rec.source, rec.data)
+	}
+	if err = c.close(); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	recs := testCaptureRecords(t)
+	got := readCaptureFile(t, writeCaptureFile(t, recs))
+	if len(got) != len(recs) {
+		t.Fatalf("%d records, want %d", len(got), len(recs))
+	}
+	for i, rec := range got {
+		if !rec.time.Equal(recs[i].time) || rec.source != recs[i].source || !bytes.Equal(rec.data, recs[i].data) {
+			t.Errorf("record %d = %s %q % x, want %s %q % x", i, rec.time, rec.source, rec.data, recs[i].time, recs[i].source, recs[i].data)
+		}
+	}
+}
+
+func TestCaptureInvalid(t *testing.T) {
+	valid, err := os.ReadFile(writeCaptureFile(t, testCaptureRecords(t)[:1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openCapture(bytes.NewReader([]byte("I104MCA"))); !errors.Is(err, errInvalidCapture) {
+		t.Errorf("short header: %v", err)
+	}
+	if _, err := openCapture(bytes.NewReader(append([]byte("I104MCAP"), 2, 0))); !errors.Is(err, errInvalidCapture) {
+		t.Errorf("version 2: %v", err)
+	}
+	for cut := 1; cut < len(valid)-len(captureMagic)-2; cut++ {
+		br, err := openCapture(bytes.NewReader(valid[:len(valid)-cut]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readCaptureRecord(br); !errors.Is(err, errInvalidCapture) {
+			t.Fatalf("record without %d bytes: %v", cut, err)
+		}
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	recs := testCaptureRecords(t)[:4]
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("UDP not available: ", err)
+	}
+	defer conn.Close()
+
+	const speed = 2
+	done := make(chan error, 1)
+	go func() { done <- replayCapture(writeCaptureFile(t, recs), conn.LocalAddr().String(), speed) }()
+
+	var first time.Time
+	buf := make([]byte, maxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, rec := range recs {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		if i == 0 {
+			first = now
+		}
+		if !bytes.Equal(buf[:n], rec.data) {
+			t.Errorf("datagram %d = % x, want % x", i, buf[:n], rec.data)
+		}
+		// the original intervals divided by the speed, with a tolerance for the scheduler
+		want := rec.time.Sub(recs[0].time) / speed
+		if got := now.Sub(first); got < want-5*time.Millisecond || got > want+100*time.Millisecond {
+			t.Errorf("datagram %d received after %s, want %s", i, got, want)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decodes the checked-in capture
+func TestDecodeCaptureFile(t *testing.T) {
+	type summary struct {
+		source  string
+		command bool
+		asdu    uint32
+		cause   uint32
+		objects []uint32 // object addresses
+	}
+	want := []summary{
+		{"192.168.0.10:8098", false, 100, 7, []uint32{0}},
+		{"192.168.0.10:8098", false, 13, 20, []uint32{1001, 1002, 1003}},
+		{"192.168.0.10:8098", false, 3, 20, []uint32{2001, 2002, 2003, 2004}},
+		{"192.168.0.10:8098", false, 100, 10, []uint32{0}},
+		{"192.168.0.10:8098", false, 30, 3, []uint32{2001}},
+		{"192.168.0.11:8098", false, 30, 3, []uint32{2001}},
+		{"192.168.0.10:8098", false, 31, 3, []uint32{2002}},
+		{"192.168.0.10:8098", false, 36, 3, []uint32{1001, 1003}},
+		{"192.168.0.20:51000", true, 45, 0, []uint32{3001}},
+		{"192.168.0.10:8098", false, 45, 7, []uint32{3001}},
+		{"192.168.0.10:8098", false, 45, 10, []uint32{3001}},
+	}
+	recs := readCaptureFile(t, testCaptureFile)
+	if len(recs) != len(want) {
+		t.Fatalf("%d records, want %d", len(recs), len(want))
+	}
+	for i, rec := range recs {
+		w := want[i]
+		if rec.source != w.source {
+			t.Errorf("record %d from %s, want %s", i, rec.source, w.source)
+		}
+		if w.command {
+			cmd, err := decodeI104MCommand(rec.data)
+			if err != nil || cmd.asdu != w.asdu || cmd.objectAddress != w.objects[0] {
+				t.Errorf("record %d: command %+v, %v", i, cmd, err)
+			}
+			continue
+		}
+		pkt, err := decodeI104MPacket(rec.data)
+		if err != nil {
+			t.Errorf("record %d: %v", i, err)
+			continue
+		}
+		if pkt.asdu != w.asdu || pkt.cause != w.cause || pkt.commonAddress != 1 || len(pkt.objects) != len(w.objects) {
+			t.Errorf("record %d: ASDU %d cause %d CA %d objects %d, want ASDU %d cause %d CA 1 objects %d",
+				i, pkt.asdu, pkt.cause, pkt.commonAddress, len(pkt.objects), w.asdu, w.cause, len(w.objects))
+			continue
+		}
+		for j, obj := range pkt.objects {
+			if obj.address != w.objects[j] {
+				t.Errorf("record %d object %d: address %d, want %d", i, j, obj.address, w.objects[j])
+			}
+		}
+	}
+	if d := recs[len(recs)-1].time.Sub(recs[0].time); d != 5900*time.Millisecond {
+		t.Errorf("capture duration %s, want 5.9s", d)
+	}
+}
@@ -0,0 +1,435 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Cancel a command on commandsQueue collection
+func commandCancel(collectionCommands *mongo.Collection, ID bson.ObjectID, cancelReason string) {
+	// write cancel to the command in mongo
+	_, err := collectionCommands.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": bson.M{"$eq": ID}},
+		bson.M{"$set": bson.M{"cancelReason": cancelReason}},
+	)
+	if err != nil {
+		log.Println(err)
+		log.Println("Mongodb - Can not write update to command on mongo!")
+	}
+}
+
+// Signals a command delvered to protocol on commandsQueue collection
+func commandDelivered(collectionCommands *mongo.Collection, ID bson.ObjectID) {
+	// write delivered to the command in mongo, ack is written when the confirmation arrives
+	_, err := collectionCommands.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": bson.M{"$eq": ID}},
+		bson.M{"$set": bson.M{"delivered": true}},
+	)
+	if err != nil {
+		log.Println(err)
+		log.Println("Mongodb - Can not write update to command on mongo!")
+	}
+}
+
+// Signals a command confirmed (ack=true) or refused (ack=false) on commandsQueue collection
+func commandAck(collectionCommands *mongo.Collection, ID bson.ObjectID, ack bool) {
+	_, err := collectionCommands.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": bson.M{"$eq": ID}},
+		bson.M{"$set": bson.M{"ack": ack, "ackTimeTag": time.Now()}},
+	)
+	if err != nil {
+		log.Println(err)
+		log.Println("Mongodb - Can not write update to command on mongo!")
+	}
+}
+
+// process commands from change stream, forward commands via UDP
+func iterateChangeStream(routineCtx context.Context, waitGroup *sync.WaitGroup, stream *mongo.ChangeStream, connections []*protocolConnection, collectionCommands *mongo.Collection) {
+	defer stream.Close(routineCtx)
+	defer waitGroup.Done()
+	for stream.Next(routineCtx) {
+		if !isActive {
+			return
+		}
+
+		var insDoc insertChange
+		if err := stream.Decode(&insDoc); err != nil {
+			log.Printf("Commands - Error: %s", err)
+			continue
+		}
+
+		var protCon *protocolConnection
+		for _, conn := range connections {
+			if conn.CommandsEnabled && !conn.ServerMode && conn.ProtocolConnectionNumber == insDoc.FullDocument.ProtocolSourceConnectionNumber {
+				protCon = conn
+				break
+			}
+		}
+
+		if insDoc.OperationType == "insert" && protCon != nil {
+			log.Printf("Commands - Command received on connection %d, %s %f", insDoc.FullDocument.ProtocolSourceConnectionNumber, insDoc.FullDocument.Tag, insDoc.FullDocument.Value)
+
+			// test for time expired, if too old command (> 10s) then cancel it
+			if time.Now().Sub(insDoc.FullDocument.TimeTag) > 10*time.Second {
+				log.Println("Commands - Command expired ", time.Now().Sub(insDoc.FullDocument.TimeTag))
+				// write cancel to the command in mongo
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, "expired")
+				continue
+			}
+
+			tiType, err := parseCommandASDU(insDoc.FullDocument.ProtocolSourceASDU)
+			if err != nil {
+				log.Printf("Commands - Command %s canceled: %v", insDoc.FullDocument.Tag, err)
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, err.Error())
+				continue
+			}
+			value, err := encodeCommandValue(tiType, insDoc.FullDocument.Value, insDoc.FullDocument.ValueString)
+			if err != nil {
+				log.Printf("Commands - Command %s canceled: %v", insDoc.FullDocument.Tag, err)
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, err.Error())
+				continue
+			}
+
+			// All is ok, so send command to I104M UPD
+
+			buf := new(bytes.Buffer)
+			var cmdSig uint32 = signatureCommand
+			err = binary.Write(buf, binary.LittleEndian, cmdSig)
+			if err != nil {
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
+				log.Println("Commands - binary.Write failed:", err)
+				continue
+			}
+			var addr uint32 = uint32(insDoc.FullDocument.ProtocolSourceObjectAddress)
+			err = binary.Write(buf, binary.LittleEndian, addr)
+			if err != nil {
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
+				log.Println("Commands - binary.Write failed:", err)
+				continue
+			}
+			err = binary.Write(buf, binary.LittleEndian, tiType)
+			if err != nil {
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
+				log.Println("Commands - binary.Write failed:", err)
+				continue
+			}
+			err = binary.Write(buf, binary.LittleEndian, value)
+			if err != nil {
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
+				log.Println("Commands - binary.Write failed:", err)
+				continue
+			}
+			var sbo uint32 = 0
+			if insDoc.FullDocument.ProtocolSourceCommandUseSBO {
+				sbo = 1
+			}
+			err = binary.Write(buf, binary.LittleEndian, sbo)
+			if err != nil {
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
+				log.Println("Commands - binary.Write failed:", err)
+				continue
+			}
+			var qu uint32 = uint32(insDoc.FullDocument.ProtocolSourceCommandDuration)
+			err = binary.Write(buf, binary.LittleEndian, qu)
+			if err != nil {
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
+				log.Println("Commands - binary.Write failed:", err)
+				continue
+			}
+			var ca uint32 = uint32(insDoc.FullDocument.ProtocolSourceCommonAddress)
+			err = binary.Write(buf, binary.LittleEndian, ca)
+			if err != nil {
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
+				log.Println("Commands - binary.Write failed:", err)
+				continue
+			}
+
+			errMsg := ""
+			ok := false
+			for i, ipAddressDest := range protCon.destinations() {
+
+				if i >= 2 { // only send to the first 2 addresses
+					break
+				}
+
+				if strings.TrimSpace(ipAddressDest) == "" {
+					errMsg = "no IP destination"
+					continue
+				}
+				err := protCon.send(protCon.sign(buf.Bytes()), ipAddressDest)
+				if err != nil {
+					errMsg = "send error"
+					log.Println("Commands - Error on IP: ", err)
+					continue
+				}
+				// success delivering command
+				log.Println("Commands - Command sent to: ", ipAddressDest)
+				ok = true
+				// log.Println(buf.Bytes())
+			}
+			if ok == true {
+				commandDelivered(collectionCommands, insDoc.FullDocument.ID)
+				protCon.stats.commandsSent.Add(1)
+				timeout := protCon.commandAckTimeout()
+				if timeout > 0 {
+					cmdTracker.add(commandKey{
+						connectionNumber: protCon.ProtocolConnectionNumber,
+						commonAddress:    ca,
+						objectAddress:    addr,
+						asdu:             tiType,
+					}, &pendingCommand{
+						id:       insDoc.FullDocument.ID,
+						tag:      insDoc.FullDocument.Tag,
+						deadline: time.Now().Add(timeout),
+						stats:    protCon.stats,
+					})
+				} else { // confirmations not expected, consider acknowledged when sent
+					commandAck(collectionCommands, insDoc.FullDocument.ID, true)
+					protCon.stats.commandsAcked.Add(1)
+				}
+			} else {
+				protCon.stats.commandsCancelled.Add(1)
+				commandCancel(collectionCommands, insDoc.FullDocument.ID, errMsg)
+				log.Println("Commands - Command canceled!")
+			}
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		log.Fatal("Commands - Changestream error: ", err)
+	}
+}
+
+// IEC 60870-5-104 names of command ASDU types
+var commandASDUNames = map[string]uint32{
+	"C_SC_NA_1": 45, "C_DC_NA_1": 46, "C_RC_NA_1": 47, "C_SE_NA_1": 48, "C_SE_NB_1": 49, "C_SE_NC_1": 50, "C_BO_NA_1": 51,
+	"C_SC_TA_1": 58, "C_DC_TA_1": 59, "C_RC_TA_1": 60, "C_SE_TA_1": 61, "C_SE_TB_1": 62, "C_SE_TC_1": 63, "C_BO_TA_1": 64,
+}
+
+// Parses the ASDU type of a command, as a number, a numeric string or an IEC name (e.g. "C_SE_NC_1")
+func parseCommandASDU(v interface{}) (uint32, error) {
+	var asdu uint32
+	switch val := v.(type) {
+	case int32:
+		asdu = uint32(val)
+	case int64:
+		asdu = uint32(val)
+	case float64:
+		asdu = uint32(val)
+	case string:
+		name := strings.ToUpper(strings.TrimSpace(val))
+		if n, ok := commandASDUNames[name]; ok {
+			asdu = n
+		} else if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+			asdu = uint32(n)
+		}
+	}
+	if !isCommandASDU(asdu) {
+		return 0, fmt.Errorf("unsupported command ASDU %v", v)
+	}
+	return asdu, nil
+}
+
+// Encodes the command value as the 32 bit value field of the I104M command packet, according to the ASDU type.
+// Returns an error describing the problem when the value is out of range for the type.
+func encodeCommandValue(asdu uint32, value float64, valueString string) (uint32, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid value %v", value)
+	}
+	switch asdu {
+	case 45, 58: // single command (SCS 0=off, 1=on)
+		if value != 0 && value != 1 {
+			return 0, fmt.Errorf("value %v out of range for single command, must be 0 or 1", value)
+		}
+		return uint32(value), nil
+	case 46, 59: // double command, I104M carries 0=off and 1=on (OSHMI maps them to the IEC DCS 1=off, 2=on)
+		if value != 0 && value != 1 {
+			return 0, fmt.Errorf("value %v out of range for double command, must be 0 (off) or 1 (on): I104M carries 0/1, not the IEC DCS 1/2", value)
+		}
+		return uint32(value), nil
+	case 47, 60: // regulating step command, I104M carries 0=lower and 1=higher (OSHMI maps them to the IEC RCS 1=lower, 2=higher)
+		if value != 0 && value != 1 {
+			return 0, fmt.Errorf("value %v out of range for regulating step command, must be 0 (lower) or 1 (higher): I104M carries 0/1, not the IEC RCS 1/2", value)
+		}
+		return uint32(value), nil
+	case 48, 61: // normalized setpoint, -1 to +1 encoded as int16 (value*32768)
+		if value < -1 || value > 1 {
+			return 0, fmt.Errorf("value %v out of range for normalized setpoint, must be -1 to 1", value)
+		}
+		n := math.Round(value * 32768)
+		if n > math.MaxInt16 {
+			n = math.MaxInt16
+		}
+		return uint32(int32(n)), nil
+	case 49, 62: // scaled setpoint, int16 (sign extended)
+		n := math.Round(value)
+		if n < math.MinInt16 || n > math.MaxInt16 {
+			return 0, fmt.Errorf("value %v out of range for scaled setpoint, must be %d to %d", value, math.MinInt16, math.MaxInt16)
+		}
+		return uint32(int32(n)), nil
+	case 50, 63: // short float setpoint, IEEE 754 single precision bits
+		if math.Abs(value) > math.MaxFloat32 {
+			return 0, fmt.Errorf("value %v out of range for short float setpoint", value)
+		}
+		return math.Float32bits(float32(value)), nil
+	case 51, 64: // bitstring of 32 bits, from valueString when available (accepts 0x, 0o, 0b prefixes)
+		if strings.TrimSpace(valueString) != "" {
+			n, err := strconv.ParseUint(strings.TrimSpace(valueString), 0, 32)
+			if err == nil {
+				return uint32(n), nil
+			}
+			return 0, fmt.Errorf("value string %q invalid for bitstring command, must be an integer 0 to %d", valueString, uint32(math.MaxUint32))
+		}
+		if value < 0 || value > math.MaxUint32 || value != math.Trunc(value) {
+			return 0, fmt.Errorf("value %v out of range for bitstring command, must be an integer 0 to %d", value, uint32(math.MaxUint32))
+		}
+		return uint32(value), nil
+	}
+	return 0, fmt.Errorf("unsupported command ASDU %d", asdu)
+}
+
+// identifies a command awaiting confirmation
+type commandKey struct {
+	connectionNumber int
+	commonAddress    uint32
+	objectAddress    uint32
+	asdu             uint32
+}
+
+type pendingCommand struct {
+	id       bson.ObjectID
+	tag      string
+	deadline time.Time // cancel with "no confirmation" when not confirmed until this time
+	stats    *connStats
+}
+
+// commandTracker correlates command confirmations received with commands sent
+type commandTracker struct {
+	mu                 sync.Mutex
+	collectionCommands *mongo.Collection
+	pending            map[commandKey]*pendingCommand
+}
+
+var cmdTracker = &commandTracker{pending: make(map[commandKey]*pendingCommand)}
+
+// tests for command ASDU types (confirmations are received with the same type of the command)
+func isCommandASDU(iecAsdu uint32) bool {
+	return (iecAsdu >= 45 && iecAsdu <= 51) || (iecAsdu >= 58 && iecAsdu <= 64)
+}
+
+// Returns the time to wait for a command confirmation, zero when confirmations are not expected
+func (protCon *protocolConnection) commandAckTimeout() time.Duration {
+	switch {
+	case protCon.CommandAckTimeoutMs < 0:
+		return 0
+	case protCon.CommandAckTimeoutMs == 0:
+		return defaultCommandAckTimeout
+	}
+	return time.Duration(protCon.CommandAckTimeoutMs * float64(time.Millisecond))
+}
+
+// Registers a command sent, a previous command to the same object still pending is cancelled
+func (t *commandTracker) add(key commandKey, cmd *pendingCommand) {
+	t.mu.Lock()
+	old := t.pending[key]
+	t.pending[key] = cmd
+	t.mu.Unlock()
+	if old != nil {
+		log.Printf("Commands - Command %s superseded before confirmation.", old.tag)
+		old.stats.commandsCancelled.Add(1)
+		commandCancel(t.collectionCommands, old.id, "superseded")
+	}
+}
+
+// Processes a command confirmation (activation confirmation or termination), returns false when not a confirmation
+func (t *commandTracker) confirm(key commandKey, cause uint32) bool {
+	cot := cause & 0x3F
+	negative := (cause & 0x40) == 0x40
+	if cot != cotActivationCon && cot != cotActivationTerm {
+		return false
+	}
+
+	t.mu.Lock()
+	cmd := t.pending[key]
+	delete(t.pending, key)
+	t.mu.Unlock()
+
+	if cmd == nil {
+		if logLevel >= logLevelDetailed {
+			log.Printf("Commands - Confirmation without pending command, ASDU %d address %d CA %d cause %d.", key.asdu, key.objectAddress, key.commonAddress, cause)
+		}
+		return true
+	}
+	if negative {
+		log.Printf("Commands - Command %s refused (negative confirmation, cause %d).", cmd.tag, cot)
+		cmd.stats.commandsRefused.Add(1)
+	} else {
+		log.Printf("Commands - Command %s confirmed (cause %d).", cmd.tag, cot)
+		cmd.stats.commandsAcked.Add(1)
+	}
+	commandAck(t.collectionCommands, cmd.id, !negative)
+	return true
+}
+
+// Cancels commands not confirmed in time, runs forever
+func (t *commandTracker) supervise() {
+	for range time.Tick(time.Second) {
+		var expired []*pendingCommand
+		now := time.Now()
+		t.mu.Lock()
+		for key, cmd := range t.pending {
+			if now.After(cmd.deadline) {
+				expired = append(expired, cmd)
+				delete(t.pending, key)
+			}
+		}
+		t.mu.Unlock()
+		for _, cmd := range expired {
+			log.Printf("Commands - Command %s not confirmed, canceled!", cmd.tag)
+			cmd.stats.commandsCancelled.Add(1)
+			commandCancel(t.collectionCommands, cmd.id, "no confirmation")
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCommandASDU(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		asdu uint32
+		err  bool
+	}{
+		{int32(45), 45, false},
+		{int64(64), 64, false},
+		{float64(50), 50, false},
+		{"51", 51, false},
+		{" c_se_nc_1 ", 50, false},
+		{"C_BO_TA_1", 64, false},
+		{int32(30), 0, true}, // monitoring type
+		{int64(52), 0, true},
+		{float64(57), 0, true},
+		{"C_SC_NB_1", 0, true},
+		{"-45", 0, true},
+		{"", 0, true},
+		{nil, 0, true},
+		{true, 0, true},
+	}
+	for _, tt := range tests {
+		asdu, err := parseCommandASDU(tt.v)
+		if (err != nil) != tt.err || asdu != tt.asdu {
+			t.Errorf("%#v: %d %v, want %d (error %v)", tt.v, asdu, err, tt.asdu, tt.err)
+		}
+	}
+}
+
+func TestEncodeCommandValue(t *testing.T) {
+	tests := []struct {
+		name        string
+		asdu        uint32
+		value       float64
+		valueString string
+		encoded     uint32
+		err         bool
+	}{
+		{"single on", 45, 1, "", 1, false},
+		{"single off with time", 58, 0, "", 0, false},
+		{"single out of range", 45, 2, "", 0, true},
+		{"double on", 46, 1, "", 1, false},
+		{"double IEC value", 59, 2, "", 0, true},
+		{"step higher", 47, 1, "", 1, false},
+		{"step IEC value", 60, 2, "", 0, true},
+		{"normalized", 48, 0.5, "", 16384, false},
+		{"normalized full scale", 48, 1, "", math.MaxInt16, false},
+		{"normalized negative", 61, -1, "", 0xffff8000, false},
+		{"normalized out of range", 48, 1.01, "", 0, true},
+		{"scaled", 49, -2.6, "", 0xfffffffd, false},
+		{"scaled maximum", 62, 32767, "", 32767, false},
+		{"scaled out of range", 49, 32768, "", 0, true},
+		{"float", 50, 123.5, "", math.Float32bits(123.5), false},
+		{"float out of range", 63, 1e39, "", 0, true},
+		{"bitstring", 51, 5, "", 5, false},
+		{"bitstring string hex", 51, 5, "0xff00", 0xff00, false},
+		{"bitstring string binary", 64, 0, " 0b101 ", 5, false},
+		{"bitstring string maximum", 51, 0, "4294967295", math.MaxUint32, false},
+		{"bitstring string fraction", 51, 1, "1.5", 0, true},
+		{"bitstring string negative", 51, 1, "-1", 0, true},
+		{"bitstring string over 32 bits", 51, 1, "4294967296", 0, true},
+		{"bitstring string exponent", 51, 1, "1e3", 0, true},
+		{"bitstring string text", 51, 1, "on", 0, true},
+		{"bitstring fraction", 51, 1.5, "", 0, true},
+		{"bitstring negative", 64, -1, "", 0, true},
+		{"NaN", 50, math.NaN(), "", 0, true},
+		{"infinite", 49, math.Inf(1), "", 0, true},
+		{"unsupported", 30, 1, "", 0, true},
+	}
+	for _, tt := range tests {
+		encoded, err := encodeCommandValue(tt.asdu, tt.value, tt.valueString)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if encoded != tt.encoded {
+			t.Errorf("%s: %08x, want %08x", tt.name, encoded, tt.encoded)
+		}
+	}
+}
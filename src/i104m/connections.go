@@ -0,0 +1,317 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	defaultIPAddressLocalBind = "0.0.0.0:8099"
+	defaultIPAddress          = "127.0.0.1:8098"
+)
+
+// packet received, routed to the connection of its source address
+type receivedPacket struct {
+	buf    []byte
+	conn   *protocolConnection
+	source string
+}
+
+// identifies a point of a connection
+type pointAddress struct {
+	connectionNumber int
+	commonAddress    uint32 // zero when the connection does not map points by common address
+	objectAddress    uint32
+}
+
+// UDP socket shared by the connections bound to the same local address
+type udpListener struct {
+	bind    string
+	udpConn *net.UDPConn
+	conns   []*protocolConnection
+}
+
+// Reads all enabled connections of the driver instance
+func getConnections(collectionConnections *mongo.Collection, instanceNumber int) ([]*protocolConnection, error) {
+	filter := bson.D{
+		{Key: "protocolDriver", Value: driverName},
+		{Key: "protocolDriverInstanceNumber", Value: instanceNumber},
+		{Key: "enabled", Value: true},
+	}
+	cursor, err := collectionConnections.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var connections []*protocolConnection
+	for cursor.Next(context.TODO()) {
+		conn := &protocolConnection{link: &linkState{}, requests: &requestLog{}, auth: &authState{}, stats: &connStats{}, scaling: &scaleCache{}}
+		if err := cursor.Decode(conn); err != nil {
+			return nil, err
+		}
+		conn.IPAddressLocalBind = strings.TrimSpace(conn.IPAddressLocalBind)
+		if conn.IPAddressLocalBind == "" {
+			conn.IPAddressLocalBind = defaultIPAddressLocalBind
+		}
+		if len(conn.IPAddresses) == 0 {
+			conn.IPAddresses = append(conn.IPAddresses, defaultIPAddress)
+		}
+		conn.parseSources()
+		conn.parseRedundantSources()
+		if conn.location, err = parseTimeZone(conn.TimeZone); err != nil {
+			return nil, fmt.Errorf("connection %d time zone: %w", conn.ProtocolConnectionNumber, err)
+		}
+		if err := conn.resolveForwardDestinations(); err != nil {
+			return nil, err
+		}
+		if err := conn.setupTransport(); err != nil {
+			return nil, err
+		}
+		connections = append(connections, conn)
+	}
+
+	if len(connections) == 0 {
+		return nil, fmt.Errorf("no enabled protocol connections found for %s instance %d", driverName, instanceNumber)
+	}
+	return connections, nil
+}
+
+// Parses the sources allowed from ipAddresses: IPv4 or IPv6 addresses (with or without port) and CIDR ranges
+func (pc *protocolConnection) parseSources() {
+	pc.sources = nil
+	for _, entry := range pc.IPAddresses {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			pc.sources = append(pc.sources, prefix.Masked())
+			continue
+		}
+		host := entry
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			host = h
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			log.Printf("Connection %d - Address %q is not an IP address or range, not accepted as source.", pc.ProtocolConnectionNumber, entry)
+			continue
+		}
+		addr = addr.Unmap()
+		pc.sources = append(pc.sources, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+}
+
+// Tests if packets from the IP address are accepted by the connection
+func (pc *protocolConnection) allowsSource(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range pc.sources {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the entries of ipAddresses that are destinations (IP:port), ranges and addresses without port are only sources.
+// For TCP returns the remote addresses of the connections established.
+func (pc *protocolConnection) destinations() []string {
+	if pc.tcp != nil {
+		return pc.tcp.peers()
+	}
+	var dests []string
+	for _, entry := range pc.IPAddresses {
+		entry = strings.TrimSpace(entry)
+		if _, _, err := net.SplitHostPort(entry); err == nil {
+			dests = append(dests, entry)
+		}
+	}
+	return dests
+}
+
+// Returns the IP address of a source address (IP:port)
+func sourceIP(source string) string {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		return source
+	}
+	return host
+}
+
+// Returns the realtimeData filter of the point with the object address (and common address when mapped by common address)
+func (pc *protocolConnection) sourceFilter(commonAddress uint32, objAddr interface{}) bson.D {
+	filter := bson.D{
+		{Key: "protocolSourceConnectionNumber", Value: pc.ProtocolConnectionNumber},
+		{Key: "protocolSourceObjectAddress", Value: objAddr},
+	}
+	if pc.MapCommonAddress {
+		filter = append(filter, bson.E{Key: "protocolSourceCommonAddress", Value: commonAddress})
+	}
+	return filter
+}
+
+// Returns the address that identifies the point in the connection
+func (pc *protocolConnection) pointAddress(commonAddress uint32, objectAddress uint32) pointAddress {
+	addr := pointAddress{connectionNumber: pc.ProtocolConnectionNumber, objectAddress: objectAddress}
+	if pc.MapCommonAddress {
+		addr.commonAddress = commonAddress
+	}
+	return addr
+}
+
+// Binds one UDP socket for each distinct local bind address of the UDP connections
+func bindListeners(connections []*protocolConnection) ([]*udpListener, error) {
+	var listeners []*udpListener
+	byBind := make(map[string]*udpListener)
+	for _, conn := range connections {
+		if conn.tcp != nil {
+			continue
+		}
+		l, ok := byBind[conn.IPAddressLocalBind]
+		if !ok {
+			serverAddr, err := net.ResolveUDPAddr("udp", conn.IPAddressLocalBind)
+			if err != nil {
+				return nil, err
+			}
+			udpConn, err := net.ListenUDP("udp", serverAddr)
+			if err != nil {
+				return nil, err
+			}
+			if err = udpConn.SetReadBuffer(1500 * udpReadBufferPackets); err != nil {
+				return nil, err
+			}
+			if logLevel >= logLevelBasic {
+				log.Printf("UDP - Binding to address: %s", conn.IPAddressLocalBind)
+			}
+			l = &udpListener{bind: conn.IPAddressLocalBind, udpConn: udpConn}
+			byBind[conn.IPAddressLocalBind] = l
+			listeners = append(listeners, l)
+		}
+		for _, other := range l.conns {
+			for _, prefix := range conn.sources {
+				for _, otherPrefix := range other.sources {
+					if prefix.Overlaps(otherPrefix) {
+						log.Printf("UDP - Sources %s of connection %d overlap %s of connection %d on %s, packets will be routed to connection %d!",
+							prefix, conn.ProtocolConnectionNumber, otherPrefix, other.ProtocolConnectionNumber, l.bind, other.ProtocolConnectionNumber)
+					}
+				}
+			}
+		}
+		conn.udpConn = l.udpConn
+		l.conns = append(l.conns, conn)
+	}
+	return listeners, nil
+}
+
+// Returns the connection that accepts packets from the source IP address, nil if none
+func (l *udpListener) route(ip netip.Addr) *protocolConnection {
+	for _, conn := range l.conns {
+		if conn.allowsSource(ip) {
+			return conn
+		}
+	}
+	return nil
+}
+
+// listen for I104M UDP packets, put packets on channel routed to the connection of the source address
+func (l *udpListener) listen(chanBuf chan receivedPacket) {
+	cntEnqPkt := 0
+	prevBuf := make(map[*protocolConnection][]byte)
+
+	for {
+		buf := make([]byte, maxPacketSize)
+
+		n, addr, err := l.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("UDP - Error: %s \n", err)
+			continue
+		}
+		if capture != nil {
+			capture.write(time.Now(), addr.String(), buf[:n])
+		}
+
+		conn := l.route(addr.AddrPort().Addr())
+		if conn == nil {
+			if logLevel >= logLevelDebug {
+				log.Printf("UDP - Message origin not allowed!\n")
+			}
+			continue
+		}
+
+		conn.stats.packetsReceived.Add(1)
+
+		if n > 4 {
+			buf = buf[:n] // only the bytes received
+			if buf, err = conn.verify(buf, time.Now()); err != nil {
+				cntRejectedPackets.Add(1)
+				conn.stats.packetsRejected.Add(1)
+				if logLevel >= logLevelBasic {
+					log.Printf("UDP - Message from %s rejected: %v", addr, err)
+				}
+				continue
+			}
+			if !conn.ServerMode { // repeated commands are valid for server connections
+				if conn.dedup != nil {
+					if conn.ignoreRedundant(buf, addr.AddrPort().Addr(), "UDP") {
+						continue
+					}
+				} else if bytes.Equal(buf, prevBuf[conn]) { // without redundant sources, only the previous packet is compared
+					conn.stats.packetsDuplicated.Add(1)
+					if logLevel >= logLevelDebug {
+						log.Printf("UDP - Duplicated message. Ignored.\n")
+					}
+					continue
+				}
+				prevBuf[conn] = buf
+			}
+
+			if !isActive { // do not process packets while inactive
+				continue
+			}
+			select {
+			case chanBuf <- receivedPacket{buf: buf, conn: conn, source: addr.String()}: // Put buffer in the channel unless it is full
+			default:
+				cntDroppedPackets.Add(1)
+				conn.stats.packetsDropped.Add(1)
+				log.Printf("UDP - Channel is full. Discarding packet! #%d", cntDroppedPackets.Load())
+				continue
+			}
+			cntEnqPkt++
+			if logLevel >= logLevelBasic {
+				log.Printf("UDP - Enqueued received packet with %d bytes from %s for connection %d, #%d", n, addr, conn.ProtocolConnectionNumber, cntEnqPkt)
+			}
+
+			// forward message to the destinations configured
+			l.forward(conn, buf)
+		} else {
+			if logLevel >= logLevelDebug {
+				log.Printf("UDP - Invalid small packet. Ignored.\n")
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	dedupRingSize          = 4096            // payloads remembered by the ring
+	defaultDedupWindow     = 2 * time.Second // identical payloads within the window are duplicates
+	defaultPrimaryTimeout  = 5 * time.Second // silence of the primary source to accept the secondary sources
+	redundantSourceUnknown = -1              // source not in redundantSources
+)
+
+// payload received in the window
+type dedupSlot struct {
+	hash   uint64
+	time   time.Time
+	source int // index of the source in redundantSources
+}
+
+// dedupRing detects identical payloads sent by redundant sources of a connection
+type dedupRing struct {
+	mu          sync.Mutex
+	sources     []netip.Prefix           // from redundantSources, the first is the primary
+	slots       [dedupRingSize]dedupSlot // last payloads received, oldest overwritten
+	next        int                      // next slot to overwrite
+	index       map[uint64]int           // slot of each payload hash in the ring
+	primaryLast time.Time                // last packet accepted from the primary source
+	standby     bool                     // secondary sources being ignored (primary alive)
+}
+
+// Parses redundantSources, logs the entries that are not IP addresses or ranges
+func (pc *protocolConnection) parseRedundantSources() {
+	if len(pc.RedundantSources) == 0 {
+		return
+	}
+	d := &dedupRing{index: make(map[uint64]int, dedupRingSize), standby: true}
+	for _, entry := range pc.RedundantSources {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			d.sources = append(d.sources, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(sourceIP(entry))
+		if err != nil {
+			log.Printf("Connection %d - Redundant source %q is not an IP address or range, ignored.", pc.ProtocolConnectionNumber, entry)
+			continue
+		}
+		addr = addr.Unmap()
+		d.sources = append(d.sources, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	if len(d.sources) > 0 {
+		pc.dedup = d
+	}
+}
+
+// Returns the index of the source IP address in redundantSources, redundantSourceUnknown if not listed
+func (d *dedupRing) sourceIndex(ip netip.Addr) int {
+	ip = ip.Unmap()
+	for i, prefix := range d.sources {
+		if prefix.Contains(ip) {
+			return i
+		}
+	}
+	return redundantSourceUnknown
+}
+
+// Returns the window of identical payloads, 0 when disabled
+func (pc *protocolConnection) dedupWindow() time.Duration {
+	switch {
+	case pc.DedupWindowMs < 0:
+		return 0
+	case pc.DedupWindowMs == 0:
+		return defaultDedupWindow
+	}
+	return time.Duration(pc.DedupWindowMs * float64(time.Millisecond))
+}
+
+// Returns the silence time of the primary source to accept the secondary sources
+func (pc *protocolConnection) primaryTimeout() time.Duration {
+	if pc.PrimaryTimeoutMs <= 0 {
+		return defaultPrimaryTimeout
+	}
+	return time.Duration(pc.PrimaryTimeoutMs * float64(time.Millisecond))
+}
+
+// Tests and counts the packets of redundant sources to be ignored, logs with the prefix of the transport
+func (pc *protocolConnection) ignoreRedundant(buf []byte, ip netip.Addr, prefix string) bool {
+	standby, duplicated := pc.redundantPacket(buf, ip, time.Now())
+	switch {
+	case standby:
+		pc.stats.packetsStandby.Add(1)
+		if logLevel >= logLevelDebug {
+			log.Printf("%s - Message from secondary source %s ignored, primary alive.\n", prefix, ip)
+		}
+	case duplicated:
+		pc.stats.packetsDuplicated.Add(1)
+		if logLevel >= logLevelDebug {
+			log.Printf("%s - Message from %s already received from a redundant source. Ignored.\n", prefix, ip)
+		}
+	}
+	return standby || duplicated
+}
+
+// Tests if a packet received from a redundant source must be ignored: from a secondary source while the
+// primary is alive (standby, when preferPrimarySource) or already received from another redundant source within the window
+// (duplicated). A copy matches only once, so a repetition by the same source is not a duplicate. Records the packet otherwise.
+func (pc *protocolConnection) redundantPacket(buf []byte, ip netip.Addr, now time.Time) (standby, duplicated bool) {
+	d := pc.dedup
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	idx := d.sourceIndex(ip)
+	if pc.PreferPrimarySource && len(d.sources) > 1 && idx != redundantSourceUnknown {
+		if idx == 0 {
+			d.primaryLast = now
+			if !d.standby {
+				d.standby = true
+				log.Printf("Connection %d - Primary source %s active, ignoring the secondary sources.", pc.ProtocolConnectionNumber, ip)
+			}
+		} else if now.Sub(d.primaryLast) < pc.primaryTimeout() {
+			return true, false
+		} else if d.standby {
+			d.standby = false
+			log.Printf("Connection %d - Primary source silent, accepting the secondary source %s.", pc.ProtocolConnectionNumber, ip)
+		}
+	}
+
+	window := pc.dedupWindow()
+	if window == 0 || idx == redundantSourceUnknown {
+		return false, false
+	}
+	h := fnv.New64a()
+	h.Write(buf)
+	sum := h.Sum64()
+	if i, ok := d.index[sum]; ok && now.Sub(d.slots[i].time) <= window && d.slots[i].source != idx {
+		delete(d.index, sum) // consumed, a later copy is accepted
+		return false, true
+	}
+	old := d.slots[d.next]
+	if i, ok := d.index[old.hash]; ok && i == d.next { // evict the oldest payload
+		delete(d.index, old.hash)
+	}
+	d.slots[d.next] = dedupSlot{hash: sum, time: now, source: idx}
+	d.index[sum] = d.next
+	d.next = (d.next + 1) % dedupRingSize
+	return false, false
+}
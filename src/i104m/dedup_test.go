@@ -0,0 +1,142 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRedundantPacket(t *testing.T) {
+	type step struct {
+		ms         int    // time of reception
+		source     string // source IP address
+		packet     string
+		standby    bool
+		duplicated bool
+	}
+	tests := []struct {
+		name    string
+		conn    protocolConnection
+		packets []step
+	}{
+		{
+			name: "same source repeat",
+			conn: protocolConnection{RedundantSources: []string{"10.0.0.1", "10.0.0.2"}},
+			packets: []step{
+				{0, "10.0.0.1", "A", false, false},
+				{100, "10.0.0.1", "A", false, false}, // repeated by the station, not a copy
+				{200, "10.0.0.1", "A", false, false},
+			},
+		},
+		{
+			name: "cross source copy",
+			conn: protocolConnection{RedundantSources: []string{"10.0.0.1", "10.0.0.2"}},
+			packets: []step{
+				{0, "10.0.0.1", "A", false, false},
+				{10, "10.0.0.2", "A", false, true},
+				{20, "10.0.0.2", "B", false, false},
+				{30, "10.0.0.1", "B", false, true},
+				{500, "10.0.0.1", "A", false, false}, // copy consumed, repeated value
+				{510, "10.0.0.2", "A", false, true},
+			},
+		},
+		{
+			name: "copies from a range",
+			conn: protocolConnection{RedundantSources: []string{"10.0.0.1", "10.0.1.0/24"}},
+			packets: []step{
+				{0, "10.0.1.7", "A", false, false},
+				{10, "10.0.0.1", "A", false, true},
+				{20, "10.0.2.1", "A", false, false}, // not a redundant source
+				{30, "::ffff:10.0.0.1", "B", false, false},
+				{40, "10.0.1.8", "B", false, true},
+			},
+		},
+		{
+			name: "window expiry",
+			conn: protocolConnection{RedundantSources: []string{"10.0.0.1", "10.0.0.2"}, DedupWindowMs: 500},
+			packets: []step{
+				{0, "10.0.0.1", "A", false, false},
+				{500, "10.0.0.2", "A", false, true}, // window inclusive
+				{1000, "10.0.0.1", "B", false, false},
+				{1501, "10.0.0.2", "B", false, false}, // expired
+			},
+		},
+		{
+			name: "window disabled",
+			conn: protocolConnection{RedundantSources: []string{"10.0.0.1", "10.0.0.2"}, DedupWindowMs: -1},
+			packets: []step{
+				{0, "10.0.0.1", "A", false, false},
+				{10, "10.0.0.2", "A", false, false},
+			},
+		},
+		{
+			name: "standby and takeover",
+			conn: protocolConnection{RedundantSources: []string{"10.0.0.1", "10.0.0.2"}, PreferPrimarySource: true, PrimaryTimeoutMs: 1000},
+			packets: []step{
+				{0, "10.0.0.1", "A", false, false},
+				{10, "10.0.0.2", "A", true, false}, // primary alive
+				{500, "10.0.0.2", "B", true, false},
+				{900, "10.0.0.1", "B", false, false},
+				{1899, "10.0.0.2", "C", true, false},  // primary silent for 999 ms
+				{1900, "10.0.0.2", "D", false, false}, // secondary takes over
+				{1950, "10.0.0.2", "E", false, false},
+				{2000, "10.0.0.1", "E", false, true}, // primary back, copy of the secondary
+				{2010, "10.0.0.2", "F", true, false}, // secondary in standby again
+				{2020, "10.0.0.1", "F", false, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := &tt.conn
+			pc.parseRedundantSources()
+			if pc.dedup == nil {
+				t.Fatal("no redundant sources")
+			}
+			start := time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC)
+			for i, s := range tt.packets {
+				now := start.Add(time.Duration(s.ms) * time.Millisecond)
+				standby, duplicated := pc.redundantPacket([]byte(s.packet), netip.MustParseAddr(s.source), now)
+				if standby != s.standby || duplicated != s.duplicated {
+					t.Errorf("packet %d (%s from %s at %d ms): standby %v duplicated %v, want %v %v",
+						i, s.packet, s.source, s.ms, standby, duplicated, s.standby, s.duplicated)
+				}
+			}
+		})
+	}
+}
+
+func TestRedundantPacketRingEviction(t *testing.T) {
+	pc := &protocolConnection{RedundantSources: []string{"10.0.0.1", "10.0.0.2"}, DedupWindowMs: 60000}
+	pc.parseRedundantSources()
+	primary, secondary := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	now := time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= dedupRingSize; i++ {
+		pc.redundantPacket([]byte{byte(i), byte(i >> 8)}, primary, now)
+	}
+	if _, duplicated := pc.redundantPacket([]byte{0, 0}, secondary, now); duplicated {
+		t.Error("oldest packet not evicted from the ring")
+	}
+	// the packet above evicted the second one, the third is still in the ring
+	if _, duplicated := pc.redundantPacket([]byte{2, 0}, secondary, now); !duplicated {
+		t.Error("packet in the ring not detected")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+)
+
+// range of object addresses (inclusive)
+type addressRange struct {
+	Start uint32 `json:"start" bson:"start"`
+	End   uint32 `json:"end" bson:"end"`
+}
+
+// destination of copies of the packets received by a connection, optionally filtered
+type forwardDestination struct {
+	Address             string         `json:"address" bson:"address"`                         // IP:port
+	AsduTypes           []uint32       `json:"asduTypes" bson:"asduTypes"`                     // forward only these ASDU types (all when empty)
+	ObjectAddressRanges []addressRange `json:"objectAddressRanges" bson:"objectAddressRanges"` // forward only objects in these ranges (all when empty)
+	udpAddr             *net.UDPAddr
+}
+
+// Resolves the forward destinations of the connection
+func (protCon *protocolConnection) resolveForwardDestinations() error {
+	for i := range protCon.ForwardDestinations {
+		fd := &protCon.ForwardDestinations[i]
+		udpAddr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(fd.Address))
+		if err != nil {
+			return fmt.Errorf("connection %d forward destination %q: %w", protCon.ProtocolConnectionNumber, fd.Address, err)
+		}
+		fd.udpAddr = udpAddr
+	}
+	return nil
+}
+
+func (fd *forwardDestination) filtered() bool {
+	return len(fd.AsduTypes) > 0 || len(fd.ObjectAddressRanges) > 0
+}
+
+// Tests if the object address is in the ranges of the destination
+func (fd *forwardDestination) matchAddress(addr uint32) bool {
+	if len(fd.ObjectAddressRanges) == 0 {
+		return true
+	}
+	for _, r := range fd.ObjectAddressRanges {
+		if addr >= r.Start && addr <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the datagram to be forwarded to the destination, nil when filtered out.
+// Only data packets pass a filter, sequence packets are reduced to the objects in the address ranges.
+func (fd *forwardDestination) filter(buf []byte) []byte {
+	if !fd.filtered() {
+		return buf
+	}
+	pkt, err := decodeI104MPacket(buf)
+	if err != nil {
+		return nil
+	}
+	if len(fd.AsduTypes) > 0 && !slices.Contains(fd.AsduTypes, pkt.asdu) {
+		return nil
+	}
+	return filterI104MPacket(buf, pkt, fd.matchAddress)
+}
+
+// Sends the datagram received to the forward destinations of the connection
+// (and to the address of JS_I104M_UDP_FORWARD_ADDRESS, unfiltered)
+func (l *udpListener) forward(conn *protocolConnection, buf []byte) {
+	if udpForwardAddress != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp", udpForwardAddress)
+		if err == nil {
+			l.udpConn.WriteToUDP(buf, udpAddr)
+		}
+	}
+	for i := range conn.ForwardDestinations {
+		fd := &conn.ForwardDestinations[i]
+		out := fd.filter(buf)
+		if out == nil {
+			continue
+		}
+		if _, err := l.udpConn.WriteToUDP(out, fd.udpAddr); err != nil {
+			log.Printf("UDP - Error forwarding to %s: %v", fd.Address, err)
+		} else if logLevel >= logLevelDebug {
+			log.Printf("UDP - Forwarded %d bytes to %s", len(out), fd.Address)
+		}
+	}
+}
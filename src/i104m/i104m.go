@@ -19,18 +19,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	plc4go "github.com/apache/plc4x/plc4go/pkg/api"
@@ -48,6 +47,8 @@ var isActive bool = false
 var logLevel = 1
 var udpForwardAddress = "" // assign a forward address for I104M UDP messages
 var pointFilter uint32 = 0
+var cntRejectedPackets atomic.Uint64 // packets rejected by the decoder
+var cntDroppedPackets atomic.Uint64  // packets discarded with the channel full
 
 const (
 	logLevelMin          = 0
@@ -56,6 +57,10 @@ const (
 	logLevelDebug        = 3
 	udpChannelSize       = 1000
 	udpReadBufferPackets = 100
+
+	defaultCommandAckTimeout = 10 * time.Second // time to wait for command confirmations
+	cotActivationCon         = 7                // cause of transmission: activation confirmation
+	cotActivationTerm        = 10               // cause of transmission: activation termination
 )
 
 type configData struct {
@@ -73,48 +78,86 @@ type configData struct {
 
 type commandQueueEntry struct {
 	ID                             bson.ObjectID `json:"_id" bson:"_id"`
-	ProtocolSourceConnectionNumber int                `json:"protocolSourceConnectionNumber"`
-	ProtocolSourceCommonAddress    int                `json:"protocolSourceCommonAddress"`
-	ProtocolSourceObjectAddress    int                `json:"protocolSourceObjectAddress"`
-	ProtocolSourceASDU             int                `json:"protocolSourceASDU"`
-	ProtocolSourceCommandDuration  int                `json:"protocolSourceCommandDuration"`
-	ProtocolSourceCommandUseSBO    bool               `json:"protocolSourceCommandUseSBO"`
-	PointKey                       int                `json:"pointKey"`
-	Tag                            string             `json:"tag"`
-	TimeTag                        time.Time          `json:"timeTag"`
-	Value                          float64            `json:"value"`
-	ValueString                    string             `json:"valueString"`
-	OriginatorUserName             string             `json:"originatorUserName"`
-	OriginatorIPAddress            string             `json:"originatorIpAddress"`
+	ProtocolSourceConnectionNumber int           `json:"protocolSourceConnectionNumber" bson:"protocolSourceConnectionNumber"`
+	ProtocolSourceCommonAddress    int           `json:"protocolSourceCommonAddress" bson:"protocolSourceCommonAddress"`
+	ProtocolSourceObjectAddress    int           `json:"protocolSourceObjectAddress" bson:"protocolSourceObjectAddress"`
+	ProtocolSourceASDU             interface{}   `json:"protocolSourceASDU" bson:"protocolSourceASDU"` // number or IEC name (e.g. "C_SC_NA_1")
+	ProtocolSourceCommandDuration  int           `json:"protocolSourceCommandDuration" bson:"protocolSourceCommandDuration"`
+	ProtocolSourceCommandUseSBO    bool          `json:"protocolSourceCommandUseSBO" bson:"protocolSourceCommandUseSBO"`
+	PointKey                       int           `json:"pointKey" bson:"pointKey"`
+	Tag                            string        `json:"tag" bson:"tag"`
+	TimeTag                        time.Time     `json:"timeTag" bson:"timeTag"`
+	Value                          float64       `json:"value" bson:"value"`
+	ValueString                    string        `json:"valueString" bson:"valueString"`
+	OriginatorUserName             string        `json:"originatorUserName" bson:"originatorUserName"`
+	OriginatorIPAddress            string        `json:"originatorIpAddress" bson:"originatorIpAddress"`
 }
 
 type insertChange struct {
-	FullDocument  commandQueueEntry `json:"fullDocument"`
-	OperationType string            `json:"operationType"`
+	FullDocument  commandQueueEntry `json:"fullDocument" bson:"fullDocument"`
+	OperationType string            `json:"operationType" bson:"operationType"`
 }
 
 type protocolDriverInstance struct {
 	ID                               bson.ObjectID `json:"_id" bson:"_id"`
-	ProtocolDriver                   string             `json:"protocolDriver"`
-	ProtocolDriverInstanceNumber     int                `json:"protocolDriverInstanceNumber"`
-	Enabled                          bool               `json:"enabled"`
-	LogLevel                         int                `json:"logLevel"`
-	NodeNames                        []string           `json:"nodeNames"`
-	ActiveNodeName                   string             `json:"activeNodeName"`
-	ActiveNodeKeepAliveTimeTag       time.Time          `json:"activeNodeKeepAliveTimeTag"`
-	KeepProtocolRunningWhileInactive bool               `json:"keepProtocolRunningWhileInactive"`
+	ProtocolDriver                   string        `json:"protocolDriver" bson:"protocolDriver"`
+	ProtocolDriverInstanceNumber     int           `json:"protocolDriverInstanceNumber" bson:"protocolDriverInstanceNumber"`
+	Enabled                          bool          `json:"enabled" bson:"enabled"`
+	LogLevel                         int           `json:"logLevel" bson:"logLevel"`
+	NodeNames                        []string      `json:"nodeNames" bson:"nodeNames"`
+	ActiveNodeName                   string        `json:"activeNodeName" bson:"activeNodeName"`
+	ActiveNodeKeepAliveTimeTag       time.Time     `json:"activeNodeKeepAliveTimeTag" bson:"activeNodeKeepAliveTimeTag"`
+	KeepProtocolRunningWhileInactive bool          `json:"keepProtocolRunningWhileInactive" bson:"keepProtocolRunningWhileInactive"`
 }
 
 type protocolConnection struct {
-	ProtocolDriver               string   `json:"protocolDriver"`
-	ProtocolDriverInstanceNumber int      `json:"protocolDriverInstanceNumber"`
-	ProtocolConnectionNumber     int      `json:"protocolConnectionNumber"`
-	Name                         string   `json:"name"`
-	Description                  string   `json:"description"`
-	Enabled                      bool     `json:"enabled"`
-	CommandsEnabled              bool     `json:"commandsEnabled"`
-	IPAddressLocalBind           string   `json:"ipAddressLocalBind"`
-	IPAddresses                  []string `json:"ipAddresses"`
+	ProtocolDriver               string               `json:"protocolDriver" bson:"protocolDriver"`
+	ProtocolDriverInstanceNumber int                  `json:"protocolDriverInstanceNumber" bson:"protocolDriverInstanceNumber"`
+	ProtocolConnectionNumber     int                  `json:"protocolConnectionNumber" bson:"protocolConnectionNumber"`
+	Name                         string               `json:"name" bson:"name"`
+	Description                  string               `json:"description" bson:"description"`
+	Enabled                      bool                 `json:"enabled" bson:"enabled"`
+	CommandsEnabled              bool                 `json:"commandsEnabled" bson:"commandsEnabled"`
+	IPAddressLocalBind           string               `json:"ipAddressLocalBind" bson:"ipAddressLocalBind"`
+	IPAddresses                  []string             `json:"ipAddresses" bson:"ipAddresses"`
+	CommandAckTimeoutMs          float64              `json:"commandAckTimeoutMs" bson:"commandAckTimeoutMs"`
+	ServerMode                   bool                 `json:"serverMode" bson:"serverMode"`                   // publish realtimeData to ipAddresses instead of receiving data
+	Topics                       []string             `json:"topics" bson:"topics"`                           // groups (group1) published by server connections
+	IntegrityInterval            float64              `json:"integrityInterval" bson:"integrityInterval"`     // seconds between integrity sends of server connections
+	AutoCreateTags               bool                 `json:"autoCreateTags" bson:"autoCreateTags"`           // create tags for object addresses not found
+	MapCommonAddress             bool                 `json:"mapCommonAddress" bson:"mapCommonAddress"`       // map points by common address and object address
+	LinkTimeoutMs                float64              `json:"linkTimeoutMs" bson:"linkTimeoutMs"`             // silence time to consider the link down
+	GiInterval                   float64              `json:"giInterval" bson:"giInterval"`                   // seconds between general interrogations (0=only on activation and link recovery, negative=disabled)
+	CiInterval                   float64              `json:"ciInterval" bson:"ciInterval"`                   // seconds between counter interrogations (0=disabled)
+	TimeSyncInterval             float64              `json:"timeSyncInterval" bson:"timeSyncInterval"`       // seconds between clock synchronizations (0=disabled)
+	ForwardDestinations          []forwardDestination `json:"forwardDestinations" bson:"forwardDestinations"` // copies of the packets received sent to other addresses
+	AuthSecret                   string               `json:"authSecret" bson:"authSecret"`                   // shared secret of HMAC authenticated datagrams (empty=no authentication)
+	TimeZone                     string               `json:"timeZone" bson:"timeZone"`                       // time zone of the time tags (empty=local, "UTC", offset as "-03:00" or zone name)
+	IgnoreSummerTimeBit          bool                 `json:"ignoreSummerTimeBit" bson:"ignoreSummerTimeBit"` // do not apply the summer time (SU) bit of time tags received
+	MaxTimeSkewMs                float64              `json:"maxTimeSkewMs" bson:"maxTimeSkewMs"`             // time tags further from the receive time are flagged not ok (0=no check)
+	NormalizedFullScale          float64              `json:"normalizedFullScale" bson:"normalizedFullScale"` // full scale of normalized values (0=1, negative=keep the raw value)
+	Transport                    string               `json:"transport" bson:"transport"`                     // "udp" (default), "tcp-client" or "tcp-server"
+	LocalCertFilePath            string               `json:"localCertFilePath" bson:"localCertFilePath"`     // certificate (PEM) of TLS over TCP (empty=no TLS)
+	PrivateKeyFilePath           string               `json:"privateKeyFilePath" bson:"privateKeyFilePath"`   // private key (PEM) of the certificate (empty=in the certificate file)
+	RootCertFilePath             string               `json:"rootCertFilePath" bson:"rootCertFilePath"`       // certificate authorities (PEM) to validate the peer
+	PeerCertFilesPaths           []string             `json:"peerCertFilesPaths" bson:"peerCertFilesPaths"`   // certificates (PEM) of the peers allowed
+	AllowOnlySpecificCerts       bool                 `json:"allowOnlySpecificCertificates" bson:"allowOnlySpecificCertificates"`
+	ChainValidation              bool                 `json:"chainValidation" bson:"chainValidation"`         // validate the peer certificate chain with rootCertFilePath
+	RedundantSources             []string             `json:"redundantSources" bson:"redundantSources"`       // sources sending the same data (the first is the primary)
+	DedupWindowMs                float64              `json:"dedupWindowMs" bson:"dedupWindowMs"`             // identical packets of redundant sources within the window are ignored (0=default, negative=disabled)
+	PreferPrimarySource          bool                 `json:"preferPrimarySource" bson:"preferPrimarySource"` // ignore the secondary sources while the primary is alive
+	PrimaryTimeoutMs             float64              `json:"primaryTimeoutMs" bson:"primaryTimeoutMs"`       // silence of the primary source to accept the secondary sources (0=default)
+	sources                      []netip.Prefix       // source addresses accepted (from ipAddresses)
+	location                     *time.Location       // time zone of the time tags
+	link                         *linkState           // supervision of packets received
+	auth                         *authState           // sequence numbers of authenticated datagrams
+	stats                        *connStats           // counters recorded in the connection document
+	scaling                      *scaleCache          // scaling of the points
+	requests                     *requestLog          // last interrogation and clock synchronization requests sent
+	autoKeyId                    int                  // last key of tags created for the connection
+	udpConn                      *net.UDPConn         // socket bound to IPAddressLocalBind
+	tcp                          *tcpTransport        // TCP connections (nil for UDP)
+	dedup                        *dedupRing           // payloads of the redundant sources (nil without redundantSources)
 }
 
 // check error, terminate app if error
@@ -167,310 +210,6 @@ func mongoConnect(cfg configData) (client *mongo.Client, collRTD *mongo.Collecti
 	return client, collRTD, collInsts, collConns, collCmds, err
 }
 
-// Cancel a command on commandsQueue collection
-func commandCancel(collectionCommands *mongo.Collection, ID bson.ObjectID, cancelReason string) {
-	// write cancel to the command in mongo
-	_, err := collectionCommands.UpdateOne(
-		context.TODO(),
-		bson.M{"_id": bson.M{"$eq": ID}},
-		bson.M{"$set": bson.M{"cancelReason": cancelReason}},
-	)
-	if err != nil {
-		log.Println(err)
-		log.Println("Mongodb - Can not write update to command on mongo!")
-	}
-}
-
-// Signals a command delvered to protocol on commandsQueue collection
-func commandDelivered(collectionCommands *mongo.Collection, ID bson.ObjectID) {
-	// write cancel to the command in mongo
-	_, err := collectionCommands.UpdateOne(
-		context.TODO(),
-		bson.M{"_id": bson.M{"$eq": ID}},
-		bson.M{"$set": bson.M{"delivered": true, "ack": true, "ackTimeTag": time.Now()}},
-	)
-	if err != nil {
-		log.Println(err)
-		log.Println("Mongodb - Can not write update to command on mongo!")
-	}
-}
-
-// process commands from change stream, forward commands via UDP
-func iterateChangeStream(routineCtx context.Context, waitGroup *sync.WaitGroup, stream *mongo.ChangeStream, protCon *protocolConnection, UdpConn *net.UDPConn, collectionCommands *mongo.Collection) {
-	defer stream.Close(routineCtx)
-	defer waitGroup.Done()
-	for stream.Next(routineCtx) {
-		if !isActive {
-			return
-		}
-
-		var insDoc insertChange
-		if err := stream.Decode(&insDoc); err != nil {
-			log.Printf("Commands - Error: %s", err)
-			continue
-		}
-
-		if insDoc.OperationType == "insert" && insDoc.FullDocument.ProtocolSourceConnectionNumber == protCon.ProtocolConnectionNumber {
-			log.Printf("Commands - Command received on connection %d, %s %f", insDoc.FullDocument.ProtocolSourceConnectionNumber, insDoc.FullDocument.Tag, insDoc.FullDocument.Value)
-
-			// test for time expired, if too old command (> 10s) then cancel it
-			if time.Now().Sub(insDoc.FullDocument.TimeTag) > 10*time.Second {
-				log.Println("Commands - Command expired ", time.Now().Sub(insDoc.FullDocument.TimeTag))
-				// write cancel to the command in mongo
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, "expired")
-				continue
-			}
-
-			// All is ok, so send command to I104M UPD
-
-			buf := new(bytes.Buffer)
-			var cmdSig uint32 = 0x4b4b4b4b
-			err := binary.Write(buf, binary.LittleEndian, cmdSig)
-			if err != nil {
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
-				log.Println("Commands - binary.Write failed:", err)
-				continue
-			}
-			var addr uint32 = uint32(insDoc.FullDocument.ProtocolSourceObjectAddress)
-			err = binary.Write(buf, binary.LittleEndian, addr)
-			if err != nil {
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
-				log.Println("Commands - binary.Write failed:", err)
-				continue
-			}
-			var tiType uint32 = uint32(insDoc.FullDocument.ProtocolSourceASDU)
-			err = binary.Write(buf, binary.LittleEndian, tiType)
-			if err != nil {
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
-				log.Println("Commands - binary.Write failed:", err)
-				continue
-			}
-			var value uint32 = uint32(insDoc.FullDocument.Value)
-			err = binary.Write(buf, binary.LittleEndian, value)
-			if err != nil {
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
-				log.Println("Commands - binary.Write failed:", err)
-				continue
-			}
-			var sbo uint32 = 0
-			if insDoc.FullDocument.ProtocolSourceCommandUseSBO {
-				sbo = 1
-			}
-			err = binary.Write(buf, binary.LittleEndian, sbo)
-			if err != nil {
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
-				log.Println("Commands - binary.Write failed:", err)
-				continue
-			}
-			var qu uint32 = uint32(insDoc.FullDocument.ProtocolSourceCommandDuration)
-			err = binary.Write(buf, binary.LittleEndian, qu)
-			if err != nil {
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
-				log.Println("Commands - binary.Write failed:", err)
-				continue
-			}
-			var ca uint32 = uint32(insDoc.FullDocument.ProtocolSourceCommonAddress)
-			err = binary.Write(buf, binary.LittleEndian, ca)
-			if err != nil {
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, "udp buffer write error")
-				log.Println("Commands - binary.Write failed:", err)
-				continue
-			}
-
-			errMsg := ""
-			ok := false
-			for i, ipAddressDest := range protCon.IPAddresses {
-
-				if i >= 2 { // only send to the first 2 addresses
-					break
-				}
-
-				if strings.TrimSpace(ipAddressDest) == "" {
-					errMsg = "no IP destination"
-					continue
-				}
-				udpAddr, err := net.ResolveUDPAddr("udp", ipAddressDest)
-				if err != nil {
-					errMsg = "IP address error"
-					log.Println("Commands - Error on IP: ", err)
-					continue
-				}
-				_, err = UdpConn.WriteToUDP(buf.Bytes(), udpAddr)
-				if err != nil {
-					errMsg = "UDP send error"
-					log.Println("Commands - Error on IP: ", err)
-					continue
-				}
-				// success delivering command
-				log.Println("Commands - Command sent to: ", ipAddressDest)
-				ok = true
-				// log.Println(buf.Bytes())
-			}
-			if ok == true {
-				commandDelivered(collectionCommands, insDoc.FullDocument.ID)
-			} else {
-				commandCancel(collectionCommands, insDoc.FullDocument.ID, errMsg)
-				log.Println("Commands - Command canceled!")
-			}
-		}
-	}
-
-	if err := stream.Err(); err != nil {
-		log.Fatal("Commands - Changestream error: ", err)
-	}
-}
-
-func i104mParseObj(oper *mongo.UpdateOneModel, buf []byte, objAddr uint32, iecAsdu uint32, cause uint32, connectionNumber int) (ok bool) {
-	var flags byte
-	var value float64
-	var f32value float32
-	var i16value int16
-	var srcTime time.Time
-	var srcTimeMSec uint16 // seconds * 1000 + milliseconds
-	var srcTimeQualityOk = false
-	var hasTime = false
-	var invalid = false
-	var notTopical = false
-	var blocked = false
-	var substituted = false
-	var overflow = false
-	var transient = false
-	var carry = false
-
-	ok = false
-
-	switch iecAsdu {
-	case 45, 46, 47:
-		if logLevel >= logLevelDetailed {
-			log.Println("Parser - Command ack")
-		}
-		return false
-	case 9, 11, 34, 35:
-		ok = true
-		flags = buf[2]
-		invalid = (flags & 0x80) == 0x80
-		notTopical = (flags & 0x40) == 0x40
-		substituted = (flags & 0x20) == 0x20
-		blocked = (flags & 0x10) == 0x10
-		buffer := bytes.NewBuffer(buf[0:])
-		binary.Read(buffer, binary.LittleEndian, &i16value)
-		value = float64(i16value)
-		if logLevel >= logLevelDetailed || pointFilter == objAddr {
-			log.Printf("Parser - Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
-		}
-	case 5, 32:
-		ok = true
-		flags = buf[1]
-		invalid = (flags & 0x80) == 0x80
-		notTopical = (flags & 0x40) == 0x40
-		substituted = (flags & 0x20) == 0x20
-		blocked = (flags & 0x10) == 0x10
-		transient = (buf[0] & 0x80) == 0x80
-		value = float64(buf[0] & 0x7F)
-		if logLevel >= logLevelDetailed || pointFilter == objAddr {
-			log.Printf("Parser - Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
-		}
-	case 13, 36: // float
-		ok = true
-		flags = buf[4]
-		overflow = (flags & 0x01) == 0x01
-		invalid = (flags & 0x80) == 0x80
-		notTopical = (flags & 0x40) == 0x40
-		substituted = (flags & 0x20) == 0x20
-		blocked = (flags & 0x10) == 0x10
-		buffer := bytes.NewBuffer(buf[0:])
-		binary.Read(buffer, binary.LittleEndian, &f32value)
-		value = float64(f32value)
-		if logLevel >= logLevelDetailed || pointFilter == objAddr {
-			log.Printf("Parser - Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
-		}
-	case 1, 2, 3, 4, 30, 31: // digital
-		ok = true
-		// convert qualifiers
-		flags = buf[0]
-		invalid = (flags&0x80) == 0x80 || (flags&0x03) == 0 || (flags&0x03) == 0x03
-		invalid = (flags & 0x80) == 0x80
-		notTopical = (flags & 0x40) == 0x40
-		substituted = (flags & 0x20) == 0x20
-		blocked = (flags & 0x10) == 0x10
-		if iecAsdu == 3 || iecAsdu == 4 || iecAsdu == 31 { // double
-			if flags&0x02 == 0x02 {
-				value = 1
-			} else {
-				value = 0
-			}
-			if flags&0x03 == 0x00 || flags&0x03 == 0x03 {
-				transient = true
-			}
-		} else { // single
-			invalid = (flags & 0x80) == 0x80
-			if flags&0x01 == 0x01 {
-				value = 1
-			} else {
-				value = 0
-			}
-		}
-		if logLevel >= logLevelDetailed || pointFilter == objAddr {
-			log.Printf("Parser - Digital %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
-		}
-	}
-	if iecAsdu == 2 || iecAsdu == 4 || iecAsdu == 30 || iecAsdu == 31 {
-		hasTime = true
-		srcTimeQualityOk = !(buf[3]&0x80 == 0x80)
-		srcTimeMSec = binary.LittleEndian.Uint16(buf[1:])
-		srcTime = time.Date(2000+int(buf[7]), time.Month(buf[6]), int(buf[5]), int(buf[4]), int(buf[3]&0x3F), int(srcTimeMSec/1000), 0 /*1000*int(srcTimeMSec%1000)*/, time.Local)
-		srcTime = srcTime.Add(time.Duration(srcTimeMSec%1000) * time.Millisecond)
-		// log.Printf(">>>> %v\n", srcTime);
-	}
-
-	if ok {
-		oper.SetFilter(bson.D{
-			{Key: "protocolSourceConnectionNumber", Value: connectionNumber},
-			{Key: "protocolSourceObjectAddress", Value: objAddr},
-		})
-
-		if hasTime {
-			oper.SetUpdate(
-				bson.D{{Key: "$set", Value: bson.D{{Key: "sourceDataUpdate", Value: bson.D{
-					{Key: "valueAtSource", Value: value},
-					{Key: "valueStringAtSource", Value: fmt.Sprintf("%f", value)},
-					{Key: "invalidAtSource", Value: invalid},
-					{Key: "notTopicalAtSource", Value: notTopical},
-					{Key: "substitutedAtSource", Value: substituted},
-					{Key: "blockedAtSource", Value: blocked},
-					{Key: "overflowAtSource", Value: overflow},
-					{Key: "transientAtSource", Value: transient},
-					{Key: "carryAtSource", Value: carry},
-					{Key: "asduAtSource", Value: fmt.Sprintf("%d", iecAsdu)},
-					{Key: "causeOfTransmissionAtSource", Value: cause},
-					{Key: "timeTag", Value: time.Now()},
-					{Key: "timeTagAtSource", Value: srcTime},
-					{Key: "timeTagAtSourceOk", Value: srcTimeQualityOk},
-				}},
-				}}})
-		} else {
-			oper.SetUpdate(
-				bson.D{{Key: "$set", Value: bson.D{{Key: "sourceDataUpdate", Value: bson.D{
-					{Key: "valueAtSource", Value: value},
-					{Key: "valueStringAtSource", Value: fmt.Sprintf("%f", value)},
-					{Key: "invalidAtSource", Value: invalid},
-					{Key: "notTopicalAtSource", Value: notTopical},
-					{Key: "substitutedAtSource", Value: substituted},
-					{Key: "blockedAtSource", Value: blocked},
-					{Key: "overflowAtSource", Value: overflow},
-					{Key: "transientAtSource", Value: transient},
-					{Key: "carryAtSource", Value: carry},
-					{Key: "asduAtSource", Value: fmt.Sprintf("%d", iecAsdu)},
-					{Key: "causeOfTransmissionAtSource", Value: cause},
-					{Key: "timeTag", Value: time.Now()},
-					{Key: "timeTagAtSourceOk", Value: false},
-				}},
-				}}})
-		}
-	}
-	return ok // , oksoe, aggrSoePipeline
-}
-
 var countKeepAliveUpdates = 0
 var countKeepAliveUpdatesLimit = 4
 var lastActiveNodeKeepAliveTimeTag time.Time
@@ -548,78 +287,6 @@ func contains(a []string, str string) bool {
 	return false
 }
 
-// find if array contains a IP address ( compare just left part of ":" as in 127.0.0.1:8099 )
-func containsIP(a []string, str string) bool {
-	tStr := strings.Split(strings.TrimSpace(str), ":")[0]
-	for _, n := range a {
-		str = strings.Split(n, ":")[0]
-		if tStr == strings.TrimSpace(str) {
-			return true
-		}
-	}
-	return false
-}
-
-// listen for I104M UDP packets, put packets on channel
-func listenI104MUdpPackets(con *net.UDPConn, ipAddresses []string, chanBuf chan []byte) {
-	cntEnqPkt := 0
-	prevBuf := make([]byte, 2048)
-
-	for {
-		buf := make([]byte, 2048)
-
-		n, addr, err := con.ReadFromUDP(buf)
-		if err != nil {
-			log.Printf("UDP - Error: %s \n", err)
-			continue
-		}
-
-		ipPort := strings.Split(addr.String(), ":")
-		if !containsIP(ipAddresses, ipPort[0]) {
-			if logLevel >= logLevelDebug {
-				log.Printf("UDP - Message origin not allowed!\n")
-			}
-			continue
-		}
-
-		if n > 4 {
-			if bytes.Equal(buf, prevBuf) {
-				if logLevel >= logLevelDebug {
-					log.Printf("UDP - Duplicated message. Ignored.\n")
-				}
-				continue
-			}
-			copy(prevBuf, buf)
-
-			if !isActive { // do not process packets while inactive
-				continue
-			}
-			select {
-			case chanBuf <- buf: // Put buffer in the channel unless it is full
-			default:
-				log.Println("UDP - Channel is full. Discarding packet!")
-				continue
-			}
-			cntEnqPkt++
-			if logLevel >= logLevelBasic {
-				log.Printf("UDP - Enqueued received packet with %d bytes from %s, #%d", n, ipPort, cntEnqPkt)
-			}
-
-			// forward message if address set
-			if udpForwardAddress != "" {
-				udpAddr, err := net.ResolveUDPAddr("udp", udpForwardAddress)
-				if err == nil {
-					con.WriteToUDP(buf, udpAddr)
-				}
-			}
-		} else {
-			if logLevel >= logLevelDebug {
-				log.Printf("UDP - Invalid small packet. Ignored.\n")
-			}
-		}
-	}
-}
-
 // this is just to add boilerplate code to avoid false positive av detection
 func __() {
 	f := excelize.NewFile()
@@ -641,6 +308,10 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	log.Println(softwareVersion)
 	log.Println("Usage i104m [instance number] [log level] [config file name] [point address filter]")
+	log.Println("      i104m replay [capture file] [destination IP:port] [speed] | i104m dump [capture file]")
+	if runCaptureTool(os.Args) {
+		return
+	}
 
 	instanceNumber := 1
 	if os.Getenv("JS_I104M_INSTANCE") != "" {
@@ -680,6 +351,23 @@ func main() {
 		udpForwardAddress = os.Getenv("JS_I104M_UDP_FORWARD_ADDRESS")
 	}
 
+	writeWindow := defaultWriteWindow
+	if os.Getenv("JS_I104M_WRITE_WINDOW_MS") != "" {
+		i, err := strconv.Atoi(os.Getenv("JS_I104M_WRITE_WINDOW_MS"))
+		if err != nil || i <= 0 {
+			log.Println("JS_I104M_WRITE_WINDOW_MS environment variable should be a positive number!")
+			os.Exit(2)
+		}
+		writeWindow = time.Duration(i) * time.Millisecond
+	}
+
+	if os.Getenv("JS_I104M_CAPTURE_FILE") != "" {
+		capture, err = newCaptureWriter(os.Getenv("JS_I104M_CAPTURE_FILE"))
+		checkFatalError(err)
+		defer capture.close()
+		log.Printf("Capture - Recording received datagrams to: %s", os.Getenv("JS_I104M_CAPTURE_FILE"))
+	}
+
 	cfgFileName := filepath.Join("..", "conf", "json-scada.json")
 	cfg := configData{}
 	if os.Getenv("JS_CONFIG_FILE") != "" {
@@ -743,61 +431,89 @@ func main() {
 	}
 
 	// read connections config
-	// This driver admits only 1 connection per instance!
-	var protocolConn protocolConnection
-	filter = bson.D{
-		{Key: "protocolDriver", Value: driverName},
-		{Key: "protocolDriverInstanceNumber", Value: instanceNumber},
-		{Key: "enabled", Value: true},
-	}
-	err = collectionConnections.FindOne(context.TODO(), filter).Decode(&protocolConn)
+	connections, err := getConnections(collectionConnections, instanceNumber)
 	checkFatalError(err)
-	if logLevel >= logLevelDebug {
-		log.Println(protocolConn)
-	}
-	if protocolConn.ProtocolDriver == "" {
-		log.Fatal("No connection found!")
-	}
-
-	if strings.TrimSpace(protocolConn.IPAddressLocalBind) == "" {
-		protocolConn.IPAddressLocalBind = "0.0.0.0:8099"
-	}
-	if logLevel >= logLevelBasic {
-		log.Printf("UDP - Binding to address: %s", protocolConn.IPAddressLocalBind)
-	}
-
-	if len(protocolConn.IPAddresses) == 0 {
-		protocolConn.IPAddresses = append(protocolConn.IPAddresses, "127.0.0.1:8098")
+	publishers := make(map[*protocolConnection]*publisher)
+	soeRec := &soeRecorder{collectionRTD: collection, collectionSOE: client.Database(cfg.MongoDatabaseName).Collection("soeData")}
+	writer := newBatchWriter(collection, soeRec, writeWindow)
+	commandsEnabled := false
+	for _, conn := range connections {
+		if logLevel >= logLevelDebug {
+			log.Println(*conn)
+		}
+		log.Printf("Instance:%d Connection:%d Bind:%s", conn.ProtocolDriverInstanceNumber, conn.ProtocolConnectionNumber, conn.IPAddressLocalBind)
+		if conn.ServerMode {
+			log.Printf("Server - Connection %d in server mode, publishing to %v", conn.ProtocolConnectionNumber, conn.IPAddresses)
+			publishers[conn] = &publisher{conn: conn, interrogation: make(chan struct{}, 1)}
+		} else {
+			commandsEnabled = commandsEnabled || conn.CommandsEnabled
+			if conn.AutoCreateTags {
+				log.Printf("Connection %d - Auto creating tags from key %d", conn.ProtocolConnectionNumber, conn.GetAutoKeyInitialValueConn(collection))
+			}
+		}
 	}
 
-	log.Printf("Instance:%d Connection:%d", protocolConn.ProtocolDriverInstanceNumber, protocolConn.ProtocolConnectionNumber)
-
-	// Lets prepare an server address at any address at port 10001
-	ServerAddr, err := net.ResolveUDPAddr("udp", protocolConn.IPAddressLocalBind)
-	checkFatalError(err)
-
-	// Now listen at selected port
-	ServerConn, err := net.ListenUDP("udp", ServerAddr)
-	checkFatalError(err)
-	defer ServerConn.Close()
-	err = ServerConn.SetReadBuffer(1500 * udpReadBufferPackets)
+	// bind one UDP socket for each distinct local address
+	listeners, err := bindListeners(connections)
 	checkFatalError(err)
+	for _, l := range listeners {
+		defer l.udpConn.Close()
+	}
 
-	var buf []byte
+	var pkt receivedPacket
 	tm := time.Now().Add(-6 * time.Second)
 
 	var waitGroup sync.WaitGroup
-	if protocolConn.CommandsEnabled {
+	if commandsEnabled {
 		waitGroup.Add(1)
 		routineCtx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		go iterateChangeStream(routineCtx, &waitGroup, csCommands, &protocolConn, ServerConn, collectionCommands)
+		cmdTracker.collectionCommands = collectionCommands
+		go cmdTracker.supervise()
+		go iterateChangeStream(routineCtx, &waitGroup, csCommands, connections, collectionCommands)
+	}
+
+	// load the scaling of the points, reloaded in the background
+	for _, conn := range connections {
+		if err := conn.loadScaling(collection); err != nil {
+			log.Printf("Scaling - Connection %d error reading scaling of points: %v", conn.ProtocolConnectionNumber, err)
+		}
+	}
+	go refreshScaling(connections, collection)
+
+	// supervise the links of the client connections
+	for _, conn := range connections {
+		conn.link.reset(time.Now())
 	}
+	go superviseLinks(connections, collection, collectionConnections)
 
-	// listen for UDP packets on a go routine, return packets via a channel (packets as []byte )
+	// send interrogations and clock synchronizations to the client connections
+	go sendRequests(connections)
+
+	// publish realtimeData to the server connections
+	if len(publishers) > 0 {
+		var list []*publisher
+		for _, p := range publishers {
+			list = append(list, p)
+			go p.runIntegrity(collection)
+		}
+		go watchPublishedPoints(collection, list)
+	}
+
+	// listen for UDP packets on go routines, return packets via a channel
 	cntDequeuedPackets := 0
-	chanBuf := make(chan []byte, udpChannelSize)
-	go listenI104MUdpPackets(ServerConn, protocolConn.IPAddresses, chanBuf)
+	chanBuf := make(chan receivedPacket, udpChannelSize)
+	for _, l := range listeners {
+		go l.listen(chanBuf)
+	}
+	// connect or accept connections of the TCP connections
+	for _, conn := range connections {
+		if conn.tcp != nil {
+			go conn.runTCP(chanBuf)
+		}
+	}
+	go writer.run()
+	go recordStats(connections, collectionConnections, writer)
 
 	for {
 		if time.Since(tm) > 5*time.Second {
@@ -819,152 +535,92 @@ func main() {
 			}
 
 			processRedundancy(collectionInstances, instance.ID, cfg)
+
+			if logLevel >= logLevelBasic {
+				log.Printf("Channel - Queue depth: %d/%d packets, %d points to write, dropped: %d, rejected: %d, updates: %d, coalesced: %d, bulk writes: %d",
+					len(chanBuf), udpChannelSize, writer.depth(), cntDroppedPackets.Load(), cntRejectedPackets.Load(),
+					writer.cntUpdates.Load(), writer.cntCoalesced.Load(), writer.cntWrites.Load())
+			}
 		}
 
 		select {
-		case buf = <-chanBuf: // receive UDP packets via channel
+		case pkt = <-chanBuf: // receive UDP packets via channel
 		case <-time.After(5 * time.Second):
 			continue
 		}
 		cntDequeuedPackets++
 
-		n := len(buf)
-		if n > 4 {
-			signature := binary.LittleEndian.Uint32(buf[0:])
-			if signature == 0x64646464 {
-
-				numpoints := binary.LittleEndian.Uint32(buf[4:])
-				iecASDU := binary.LittleEndian.Uint32(buf[8:])
-				primaryAddr := binary.LittleEndian.Uint32(buf[12:])
-				secondaryAddr := binary.LittleEndian.Uint32(buf[16:])
-				cause := binary.LittleEndian.Uint32(buf[20:])
-				infoSize := binary.LittleEndian.Uint32(buf[24:])
-				incinfo := uint32(0)
-				ok := true
-
-				if logLevel >= logLevelBasic {
-					log.Println("Channel - Received Seqncy ",
-						// n, " ",
-						// signature, " ",
-						numpoints, " ",
-						iecASDU, " ",
-						primaryAddr, " ",
-						secondaryAddr, " ",
-						cause, " ",
-						infoSize, " #", cntDequeuedPackets)
-				}
+		if p := publishers[pkt.conn]; p != nil { // server connections receive only commands
+			p.command(pkt.buf, pkt.source, collectionCommands)
+			continue
+		}
 
-				switch {
-				case iecASDU == 1 || // simples sem tag
-					iecASDU == 3: // duplo sem tag
-					incinfo = 4 + 1
-				case iecASDU == 2 || // simples com tag
-					iecASDU == 4: // duplo com tag
-					incinfo = 4 + 1 + 3
-				case iecASDU == 30 || // simples com tag longa
-					iecASDU == 31: // duplo com tag longa
-					incinfo = 4 + 1 + 7
-				case iecASDU == 5: // reg pos
-					incinfo = 4 + 2
-				case iecASDU == 32: // reg pos c/ tag
-					incinfo = 4 + 2 + 7
-				case iecASDU == 9 || // normalized
-					iecASDU == 11: // scaled
-					incinfo = 4 + 3
-				case iecASDU == 34 || // normalized c/ tag
-					iecASDU == 35: // scaled c/ tag
-					incinfo = 4 + 3 + 7
-				case iecASDU == 13: // ponto flutuante
-					incinfo = 4 + 5
-				case iecASDU == 36: // ponto flutuante c/ tag
-					incinfo = 4 + 5 + 7
-				case iecASDU == 15:
-					incinfo = 4 + 5
-				default:
-					ok = false
-					if logLevel >= logLevelDebug {
-						log.Printf("Channel - ASDU type [%d] not supported", iecASDU)
-					}
-					return
-				}
+		decoded, err := decodeI104MPacket(pkt.buf)
+		if err != nil {
+			cntRejectedPackets.Add(1)
+			pkt.conn.stats.packetsRejected.Add(1)
+			if logLevel >= logLevelBasic {
+				log.Printf("Channel - Invalid message from %s rejected: %v, #%d", pkt.source, err, cntRejectedPackets.Load())
+			}
+			continue
+		}
+		pkt.conn.stats.packetsAccepted.Add(1)
+		if pkt.conn.link.received(sourceIP(pkt.source), time.Now()) {
+			log.Printf("Link - Connection %d UP, packet from %s.", pkt.conn.ProtocolConnectionNumber, pkt.source)
+			pkt.conn.recordLink(collectionConnections)
+			if pkt.conn.GiInterval >= 0 { // update all points after the link recovery
+				pkt.conn.sendRequest(asduInterrogation, time.Now())
+			}
+		}
 
-				if ok {
-					t1 := time.Now()
-					var opers []mongo.WriteModel
-					// var opersSOE []mongo.WriteModel
-					for i := uint32(0); i < numpoints; i++ {
-						oper := mongo.NewUpdateOneModel()
-						objAddr := binary.LittleEndian.Uint32(buf[28+i*incinfo:])
-						okrt := i104mParseObj(oper, buf[32+i*incinfo:], objAddr, iecASDU, cause, protocolConn.ProtocolConnectionNumber)
-						if okrt {
-							opers = append(opers, oper)
-						}
-					}
-					if len(opers) > 0 {
-						res, err := collection.BulkWrite(
-							context.Background(),
-							opers,
-							options.BulkWrite().SetOrdered(false),
-						)
-						if res == nil {
-							log.Print("Mongodb - bulk error!")
-							log.Fatal(err)
-						}
-						t2 := time.Now()
-
-						if logLevel >= logLevelDetailed {
-							log.Printf("Mongodb - Matched count: %d, Updated Count: %d, Bulk upsert time: %d ms \n", res.MatchedCount, res.ModifiedCount, t2.Sub(t1).Milliseconds())
-							if numpoints > 20 {
-								log.Printf("Mongodb - %d bulk upserts/s\n", int64(float64(numpoints)/t2.Sub(t1).Seconds()))
-							}
-						}
-					}
-				}
-			} else if signature == 0x53535353 {
-
-				objAddr := binary.LittleEndian.Uint32(buf[4:])
-				iecASDU := binary.LittleEndian.Uint32(buf[8:])
-				primaryAddr := binary.LittleEndian.Uint32(buf[12:])
-				secondaryAddr := binary.LittleEndian.Uint32(buf[16:])
-				cause := binary.LittleEndian.Uint32(buf[20:])
-				infoSize := binary.LittleEndian.Uint32(buf[24:])
-
-				if logLevel >= logLevelBasic {
-					log.Println("Channel - Received Single ",
-						// n, " ",
-						// signature, " ",
-						objAddr, " ",
-						iecASDU, " ",
-						primaryAddr, " ",
-						secondaryAddr, " ",
-						cause, " ",
-						infoSize, " #", cntDequeuedPackets)
-				}
+		if isSystemCommandASDU(decoded.asdu) { // confirmation of an interrogation or clock synchronization request
+			if logLevel >= logLevelDetailed {
+				log.Printf("Channel - Connection %d confirmation of ASDU %d from %s, cause %d",
+					pkt.conn.ProtocolConnectionNumber, decoded.asdu, pkt.source, decoded.cause)
+			}
+			continue
+		}
 
-				var opers []mongo.WriteModel
-				oper := mongo.NewUpdateOneModel()
-				okrt := i104mParseObj(oper, buf[28:], objAddr, iecASDU, cause, protocolConn.ProtocolConnectionNumber)
-				if okrt {
-					opers = append(opers, oper)
-					res, err := collection.BulkWrite(
-						context.Background(),
-						opers,
-					)
-					if res == nil {
-						log.Print("Mongodb - bulk error!")
-						log.Fatal(err)
-					}
-					log.Println(res)
-				}
+		if logLevel >= logLevelBasic {
+			if decoded.signature == signatureSequence {
+				log.Println("Channel - Received Seqncy ",
+					pkt.conn.ProtocolConnectionNumber, " ",
+					len(decoded.objects), " ",
+					decoded.asdu, " ",
+					decoded.commonAddress, " ",
+					decoded.secondaryAddr, " ",
+					decoded.cause, " ",
+					decoded.infoSize, " #", cntDequeuedPackets)
 			} else {
-				if logLevel >= logLevelBasic {
-					log.Println("Channel - Invalid message!")
-				}
+				log.Println("Channel - Received Single ",
+					pkt.conn.ProtocolConnectionNumber, " ",
+					decoded.objects[0].address, " ",
+					decoded.asdu, " ",
+					decoded.commonAddress, " ",
+					decoded.secondaryAddr, " ",
+					decoded.cause, " ",
+					decoded.infoSize, " #", cntDequeuedPackets)
 			}
+		}
 
-			if err != nil {
-				log.Println("Channel - Error: ", err)
+		var addrs []pointAddress
+		var opers []mongo.WriteModel
+		var events []*soeEvent
+		for _, obj := range decoded.objects {
+			oper := mongo.NewUpdateOneModel()
+			ok, ev := i104mParseObj(oper, obj.info, obj.address, decoded.asdu, decoded.cause, decoded.commonAddress, pkt.conn)
+			if ok {
+				addrs = append(addrs, pkt.conn.pointAddress(decoded.commonAddress, obj.address))
+				opers = append(opers, oper)
+				if pkt.conn.AutoCreateTags {
+					pkt.conn.AutoCreateTag(decoded.commonAddress, obj.address, decoded.asdu, collection)
+				}
+			}
+			if ev != nil {
+				events = append(events, ev)
 			}
 		}
+		pkt.conn.stats.pointsUpdated.Add(uint64(len(opers)))
+		writer.add(addrs, opers, events)
 	}
 }
@@ -0,0 +1,109 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// last requests sent by a client connection
+type requestLog struct {
+	mu            sync.Mutex
+	interrogation time.Time
+	counters      time.Time
+	clockSync     time.Time
+}
+
+// Sends an interrogation or clock synchronization request to the first 2 addresses of the connection
+func (protCon *protocolConnection) sendRequest(asdu uint32, t time.Time) {
+	cmd := &i104mCommand{asdu: asdu, commonAddress: broadcastCommonAddress}
+	var timeTag []byte
+	switch asdu {
+	case asduInterrogation:
+		cmd.value = qoiStation
+	case asduCounterInterrogation:
+		cmd.value = qccGeneralRequest
+	case asduClockSync:
+		timeTag = encodeCP56Time(t.In(protCon.location), true)
+	}
+	buf := protCon.sign(encodeI104MCommand(cmd, timeTag))
+
+	for i, ipAddressDest := range protCon.destinations() {
+		if i >= 2 { // only send to the first 2 addresses, as commands
+			break
+		}
+		if err := protCon.send(buf, ipAddressDest); err != nil {
+			log.Println("Requests - Error on IP: ", err)
+			continue
+		}
+		if logLevel >= logLevelBasic {
+			log.Printf("Requests - Connection %d sent ASDU %d to %s", protCon.ProtocolConnectionNumber, asdu, ipAddressDest)
+		}
+	}
+
+	protCon.requests.mu.Lock()
+	defer protCon.requests.mu.Unlock()
+	switch asdu {
+	case asduInterrogation:
+		protCon.requests.interrogation = t
+	case asduCounterInterrogation:
+		protCon.requests.counters = t
+	case asduClockSync:
+		protCon.requests.clockSync = t
+	}
+}
+
+// Tests if a periodic request is due, interval in seconds (zero or negative is not periodic)
+func requestDue(last time.Time, interval float64, t time.Time) bool {
+	return interval > 0 && t.Sub(last) >= time.Duration(interval*float64(time.Second))
+}
+
+// Sends the interrogations and clock synchronizations of the client connections when
+// the node becomes active and then periodically as configured. Runs forever.
+func sendRequests(connections []*protocolConnection) {
+	wasActive := false
+	for t := range time.Tick(time.Second) {
+		activated := isActive && !wasActive
+		wasActive = isActive
+		if !isActive {
+			continue
+		}
+		for _, conn := range connections {
+			if conn.ServerMode {
+				continue
+			}
+			conn.requests.mu.Lock()
+			gi := conn.GiInterval >= 0 && (activated || requestDue(conn.requests.interrogation, conn.GiInterval, t))
+			ci := conn.CiInterval > 0 && (activated || requestDue(conn.requests.counters, conn.CiInterval, t))
+			ts := conn.TimeSyncInterval > 0 && (activated || requestDue(conn.requests.clockSync, conn.TimeSyncInterval, t))
+			conn.requests.mu.Unlock()
+			if ts { // synchronize the clock first, so that the interrogated values have correct time tags
+				conn.sendRequest(asduClockSync, t)
+			}
+			if gi {
+				conn.sendRequest(asduInterrogation, t)
+			}
+			if ci {
+				conn.sendRequest(asduCounterInterrogation, t)
+			}
+		}
+	}
+}
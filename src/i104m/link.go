@@ -0,0 +1,216 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const defaultLinkTimeout = 60 * time.Second // silence time to consider the link of a connection down
+
+// linkState supervises the packets received by a connection
+type linkState struct {
+	mu         sync.Mutex
+	up         bool
+	changed    time.Time            // time of the last transition
+	lastPacket time.Time            // last valid packet from any source
+	sources    map[string]time.Time // last valid packet by source IP address
+}
+
+// Returns the silence time to consider the link down, zero when supervision is disabled
+func (protCon *protocolConnection) linkTimeout() time.Duration {
+	switch {
+	case protCon.LinkTimeoutMs < 0:
+		return 0
+	case protCon.LinkTimeoutMs == 0:
+		return defaultLinkTimeout
+	}
+	return time.Duration(protCon.LinkTimeoutMs * float64(time.Millisecond))
+}
+
+// Registers a valid packet received from the source IP address, returns true when the link was down
+func (l *linkState) received(ip string, t time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sources == nil {
+		l.sources = make(map[string]time.Time)
+	}
+	l.sources[ip] = t
+	l.lastPacket = t
+	if l.up {
+		return false
+	}
+	l.up = true
+	l.changed = t
+	return true
+}
+
+// Tests for silence longer than the timeout, returns true when the link goes down
+func (l *linkState) expired(t time.Time, timeout time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.up || t.Sub(l.lastPacket) <= timeout {
+		return false
+	}
+	l.up = false
+	l.changed = t
+	return true
+}
+
+// Restarts supervision as if a packet was just received, used while the node is inactive
+func (l *linkState) reset(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastPacket = t
+	if l.changed.IsZero() {
+		l.up = true
+		l.changed = t
+	}
+}
+
+// Returns the last valid packet time of the sources, sorted by address. Must be called with the lock held.
+func (l *linkState) sourcesLocked() bson.A {
+	var addrs []string
+	for ip := range l.sources {
+		addrs = append(addrs, ip)
+	}
+	sort.Strings(addrs)
+	sources := bson.A{}
+	for _, ip := range addrs {
+		sources = append(sources, bson.D{{Key: "address", Value: ip}, {Key: "lastPacketTimeTag", Value: l.sources[ip]}})
+	}
+	return sources
+}
+
+// Returns the last valid packet time of the sources
+func (l *linkState) sourceList() bson.A {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sourcesLocked()
+}
+
+// Returns the link status to be recorded in the connection document
+func (l *linkState) document() bson.D {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	doc := bson.D{
+		{Key: "up", Value: l.up},
+		{Key: "timeTag", Value: l.changed},
+		{Key: "sources", Value: l.sourcesLocked()},
+	}
+	if !l.lastPacket.IsZero() {
+		doc = append(doc, bson.E{Key: "lastPacketTimeTag", Value: l.lastPacket})
+	}
+	return doc
+}
+
+// Records the link status in the protocolConnections collection
+func (protCon *protocolConnection) recordLink(collectionConnections *mongo.Collection) {
+	_, err := collectionConnections.UpdateOne(context.TODO(),
+		bson.D{
+			{Key: "protocolDriver", Value: driverName},
+			{Key: "protocolConnectionNumber", Value: protCon.ProtocolConnectionNumber},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "link", Value: protCon.link.document()}}}},
+	)
+	if err != nil {
+		log.Printf("Link - Connection %d error recording link status: %v", protCon.ProtocolConnectionNumber, err)
+	}
+}
+
+// Marks all points of the connection as invalid and not topical, keeping the last values.
+// The source time tag is cleared so that the change is not taken as an event.
+// The whole sourceDataUpdate is set for each point, as expected by the data processor.
+func (protCon *protocolConnection) invalidatePoints(collection *mongo.Collection) {
+	filter := bson.D{
+		{Key: "protocolSourceConnectionNumber", Value: protCon.ProtocolConnectionNumber},
+		{Key: "origin", Value: bson.D{{Key: "$ne", Value: "command"}}},
+		{Key: "sourceDataUpdate", Value: bson.D{{Key: "$exists", Value: true}}},
+	}
+	cursor, err := collection.Find(context.TODO(), filter, options.Find().SetProjection(bson.D{{Key: "sourceDataUpdate", Value: 1}}))
+	if err != nil {
+		log.Printf("Link - Connection %d error invalidating points: %v", protCon.ProtocolConnectionNumber, err)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	now := time.Now()
+	var opers []mongo.WriteModel
+	for cursor.Next(context.TODO()) {
+		var pt struct {
+			ID               interface{} `bson:"_id"`
+			SourceDataUpdate bson.M      `bson:"sourceDataUpdate"`
+		}
+		if err := cursor.Decode(&pt); err != nil || pt.SourceDataUpdate == nil {
+			continue
+		}
+		update := pt.SourceDataUpdate
+		readTimeTag := update["timeTag"] // the point is not overwritten when updated after it was read
+		update["invalidAtSource"] = true
+		update["notTopicalAtSource"] = true
+		update["timeTagAtSource"] = nil
+		update["timeTagAtSourceOk"] = false
+		update["soeRecorded"] = false
+		update["timeTag"] = now
+		opers = append(opers, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: pt.ID}, {Key: "sourceDataUpdate.timeTag", Value: readTimeTag}}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "sourceDataUpdate", Value: update}}}}))
+	}
+	if err := cursor.Err(); err != nil {
+		log.Printf("Link - Connection %d error reading points to invalidate: %v", protCon.ProtocolConnectionNumber, err)
+	}
+	if len(opers) == 0 {
+		return
+	}
+	res, err := collection.BulkWrite(context.TODO(), opers, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		log.Printf("Link - Connection %d error invalidating points: %v", protCon.ProtocolConnectionNumber, err)
+		return
+	}
+	log.Printf("Link - Connection %d, %d points marked invalid.", protCon.ProtocolConnectionNumber, res.ModifiedCount)
+}
+
+// Supervises the links of the client connections, invalidating the points when a link goes down. Runs forever.
+func superviseLinks(connections []*protocolConnection, collection *mongo.Collection, collectionConnections *mongo.Collection) {
+	for t := range time.Tick(time.Second) {
+		for _, conn := range connections {
+			timeout := conn.linkTimeout()
+			if conn.ServerMode || timeout == 0 {
+				continue
+			}
+			if !isActive { // packets are not processed while inactive
+				conn.link.reset(t)
+				continue
+			}
+			if conn.link.expired(t, timeout) {
+				log.Printf("Link - Connection %d DOWN, no valid packets for %s.", conn.ProtocolConnectionNumber, timeout)
+				conn.invalidatePoints(collection)
+				conn.recordLink(collectionConnections)
+			}
+		}
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	signatureSequence = 0x64646464 // packet with a sequence of objects of the same ASDU type
+	signatureSingle   = 0x53535353 // packet with a single object
+	signatureCommand  = 0x4b4b4b4b // command packet
+	packetHeaderSize  = 28         // signature, number of points (or object address), ASDU, addresses, cause, info size
+	maxPacketSize     = 2048       // maximum size of an I104M datagram
+)
+
+// errors of packet decoding
+var (
+	errPacketTooShort    = errors.New("packet too short")
+	errPacketTruncated   = errors.New("packet truncated")
+	errUnknownSignature  = errors.New("unknown signature")
+	errUnsupportedASDU   = errors.New("unsupported ASDU type")
+	errInvalidPointCount = errors.New("invalid number of points")
+	errInfoSizeMismatch  = errors.New("information size does not match the ASDU type")
+)
+
+// information object of a packet
+type i104mObject struct {
+	address uint32
+	info    []byte // information element including the time tag, sized as the layout of the ASDU type
+}
+
+// decoded I104M data packet
+type i104mPacket struct {
+	signature     uint32
+	asdu          uint32
+	commonAddress uint32 // primary address
+	secondaryAddr uint32
+	cause         uint32
+	infoSize      uint32
+	objects       []i104mObject
+}
+
+// Decodes a data packet (sequence or single), buf must be sized as the datagram received.
+// The objects reference the memory of buf.
+func decodeI104MPacket(buf []byte) (*i104mPacket, error) {
+	n := len(buf)
+	if n < 4 {
+		return nil, fmt.Errorf("%w: %d bytes", errPacketTooShort, n)
+	}
+	pkt := &i104mPacket{signature: binary.LittleEndian.Uint32(buf[0:])}
+	if pkt.signature != signatureSequence && pkt.signature != signatureSingle {
+		return nil, fmt.Errorf("%w: %08x", errUnknownSignature, pkt.signature)
+	}
+	if n < packetHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", errPacketTooShort, n)
+	}
+
+	count := binary.LittleEndian.Uint32(buf[4:]) // number of points or object address for single packets
+	pkt.asdu = binary.LittleEndian.Uint32(buf[8:])
+	pkt.commonAddress = binary.LittleEndian.Uint32(buf[12:])
+	pkt.secondaryAddr = binary.LittleEndian.Uint32(buf[16:])
+	pkt.cause = binary.LittleEndian.Uint32(buf[20:])
+	pkt.infoSize = binary.LittleEndian.Uint32(buf[24:])
+
+	layout, found := asduLayouts[pkt.asdu]
+	if !found {
+		layout, found = systemCommandLayouts[pkt.asdu] // confirmations of interrogations and clock synchronization
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedASDU, pkt.asdu)
+	}
+	elemSize := layout.infoSize + layout.timeSize
+	if pkt.infoSize != uint32(elemSize) {
+		return nil, fmt.Errorf("%w: %d bytes, ASDU %d has %d", errInfoSizeMismatch, pkt.infoSize, pkt.asdu, elemSize)
+	}
+
+	if pkt.signature == signatureSingle {
+		if n < packetHeaderSize+elemSize {
+			return nil, fmt.Errorf("%w: %d bytes, ASDU %d needs %d", errPacketTruncated, n, pkt.asdu, packetHeaderSize+elemSize)
+		}
+		pkt.objects = []i104mObject{{address: count, info: buf[packetHeaderSize : packetHeaderSize+elemSize]}}
+		return pkt, nil
+	}
+
+	incinfo := 4 + elemSize // object address + information element
+	if count == 0 || uint64(count) > uint64((n-packetHeaderSize)/incinfo) {
+		if count == 0 || uint64(count)*uint64(incinfo) > maxPacketSize {
+			return nil, fmt.Errorf("%w: %d", errInvalidPointCount, count)
+		}
+		return nil, fmt.Errorf("%w: %d bytes, %d points of ASDU %d need %d", errPacketTruncated, n, count, pkt.asdu, packetHeaderSize+int(count)*incinfo)
+	}
+	pkt.objects = make([]i104mObject, count)
+	for i := range pkt.objects {
+		pos := packetHeaderSize + i*incinfo
+		pkt.objects[i] = i104mObject{
+			address: binary.LittleEndian.Uint32(buf[pos:]),
+			info:    buf[pos+4 : pos+incinfo],
+		}
+	}
+	return pkt, nil
+}
+
+// size of a command packet: signature, object address, ASDU, value, select, qualifier, common address
+// (clock synchronization commands have also a CP56Time2a time tag at the end)
+const commandPacketSize = 28
+
+// system commands
+const (
+	asduInterrogation        = 100 // general interrogation, value is the qualifier of interrogation
+	asduCounterInterrogation = 101 // counter interrogation, value is the qualifier of counter interrogation
+	asduClockSync            = 103 // clock synchronization, followed by the time tag
+	qoiStation               = 20  // qualifier of interrogation: station interrogation
+	qccGeneralRequest        = 5   // qualifier of counter interrogation: general request counter, no freeze
+	broadcastCommonAddress   = 65535
+)
+
+// layouts of the system commands, as echoed in the confirmations
+var systemCommandLayouts = map[uint32]asduLayout{
+	asduInterrogation:        {1, 0},
+	asduCounterInterrogation: {1, 0},
+	asduClockSync:            {0, 7},
+}
+
+// command packet (signature 0x4b4b4b4b)
+type i104mCommand struct {
+	objectAddress uint32
+	asdu          uint32
+	value         uint32 // encoded according to the ASDU type
+	sbo           bool
+	qualifier     uint32
+	commonAddress uint32
+}
+
+// Decodes a command packet, buf must be sized as the datagram received
+func decodeI104MCommand(buf []byte) (*i104mCommand, error) {
+	if len(buf) < commandPacketSize {
+		return nil, fmt.Errorf("%w: %d bytes", errPacketTooShort, len(buf))
+	}
+	if sig := binary.LittleEndian.Uint32(buf[0:]); sig != signatureCommand {
+		return nil, fmt.Errorf("%w: %08x", errUnknownSignature, sig)
+	}
+	cmd := &i104mCommand{
+		objectAddress: binary.LittleEndian.Uint32(buf[4:]),
+		asdu:          binary.LittleEndian.Uint32(buf[8:]),
+		value:         binary.LittleEndian.Uint32(buf[12:]),
+		sbo:           binary.LittleEndian.Uint32(buf[16:]) != 0,
+		qualifier:     binary.LittleEndian.Uint32(buf[20:]),
+		commonAddress: binary.LittleEndian.Uint32(buf[24:]),
+	}
+	if !isCommandASDU(cmd.asdu) && !isSystemCommandASDU(cmd.asdu) {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedASDU, cmd.asdu)
+	}
+	return cmd, nil
+}
+
+// tests for system command ASDU types (interrogations and clock synchronization)
+func isSystemCommandASDU(asdu uint32) bool {
+	return asdu == asduInterrogation || asdu == asduCounterInterrogation || asdu == asduClockSync
+}
+
+// Encodes a command packet, the time tag is appended when not nil
+func encodeI104MCommand(cmd *i104mCommand, timeTag []byte) []byte {
+	buf := make([]byte, commandPacketSize, commandPacketSize+len(timeTag))
+	binary.LittleEndian.PutUint32(buf[0:], signatureCommand)
+	binary.LittleEndian.PutUint32(buf[4:], cmd.objectAddress)
+	binary.LittleEndian.PutUint32(buf[8:], cmd.asdu)
+	binary.LittleEndian.PutUint32(buf[12:], cmd.value)
+	if cmd.sbo {
+		binary.LittleEndian.PutUint32(buf[16:], 1)
+	}
+	binary.LittleEndian.PutUint32(buf[20:], cmd.qualifier)
+	binary.LittleEndian.PutUint32(buf[24:], cmd.commonAddress)
+	return append(buf, timeTag...)
+}
+
+// Returns a data packet with only the objects accepted by keep (same header), nil when no object is accepted.
+// The packet is returned unchanged when all objects are accepted.
+func filterI104MPacket(buf []byte, pkt *i104mPacket, keep func(address uint32) bool) []byte {
+	var kept []i104mObject
+	for _, obj := range pkt.objects {
+		if keep(obj.address) {
+			kept = append(kept, obj)
+		}
+	}
+	switch {
+	case len(kept) == 0:
+		return nil
+	case len(kept) == len(pkt.objects):
+		return buf
+	}
+	out := make([]byte, packetHeaderSize, packetHeaderSize+len(kept)*(4+len(kept[0].info)))
+	copy(out, buf[:packetHeaderSize])
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(kept)))
+	for _, obj := range kept {
+		out = binary.LittleEndian.AppendUint32(out, obj.address)
+		out = append(out, obj.info...)
+	}
+	return out
+}
+
+// Encodes the header of a data packet, count is the number of points (sequence) or the object address (single)
+func encodePacketHeader(signature uint32, count uint32, asdu uint32, commonAddress uint32, cause uint32, infoSize int) []byte {
+	buf := make([]byte, packetHeaderSize, maxPacketSize)
+	binary.LittleEndian.PutUint32(buf[0:], signature)
+	binary.LittleEndian.PutUint32(buf[4:], count)
+	binary.LittleEndian.PutUint32(buf[8:], asdu)
+	binary.LittleEndian.PutUint32(buf[12:], commonAddress)
+	binary.LittleEndian.PutUint32(buf[16:], 0)
+	binary.LittleEndian.PutUint32(buf[20:], cause)
+	binary.LittleEndian.PutUint32(buf[24:], uint32(infoSize))
+	return buf
+}
+
+// Encodes a single packet with one object
+func encodeI104MSingle(asdu uint32, commonAddress uint32, cause uint32, obj i104mObject) []byte {
+	buf := encodePacketHeader(signatureSingle, obj.address, asdu, commonAddress, cause, len(obj.info))
+	return append(buf, obj.info...)
+}
+
+// Encodes sequence packets with objects of the same ASDU type, split in as many packets as needed to respect the maximum packet size
+func encodeI104MSequence(asdu uint32, commonAddress uint32, cause uint32, objects []i104mObject) [][]byte {
+	var packets [][]byte
+	for len(objects) > 0 {
+		incinfo := 4 + len(objects[0].info)
+		count := (maxPacketSize - packetHeaderSize) / incinfo
+		if count > len(objects) {
+			count = len(objects)
+		}
+		buf := encodePacketHeader(signatureSequence, uint32(count), asdu, commonAddress, cause, len(objects[0].info))
+		for _, obj := range objects[:count] {
+			buf = binary.LittleEndian.AppendUint32(buf, obj.address)
+			buf = append(buf, obj.info...)
+		}
+		packets = append(packets, buf)
+		objects = objects[count:]
+	}
+	return packets
+}
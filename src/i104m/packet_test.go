@@ -0,0 +1,162 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// packets as sent by OSHMI (I104M)
+var (
+	// sequence of 2 short floats (ASDU 13), common address 1, cause 3, objects 1001 = 123.5 and 1002 = -1.25 (invalid)
+	pktSequenceFloat = "64646464 02000000 0d000000 01000000 00000000 03000000 05000000" +
+		"e9030000 0000f742 00" +
+		"ea030000 0000a0bf 80"
+	// single point with CP56 time tag (ASDU 30), object 2001 on, 2025-03-15 12:30:15.000
+	pktSingleSPTB = "53535353 d1070000 1e000000 01000000 00000000 03000000 08000000" +
+		"01 983a 1e 0c 0f 03 19"
+	// single command (ASDU 45), object 3001, value 1, direct execute, common address 1
+	pktCommandSingle = "4b4b4b4b b90b0000 2d000000 01000000 00000000 00000000 01000000"
+	// confirmation of general interrogation (ASDU 100), common address 1, cause 7, qualifier 20
+	pktConfirmationGI = "53535353 00000000 64000000 01000000 00000000 07000000 01000000 14"
+)
+
+func mustHex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodeI104MPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  string
+		cut     int // bytes removed from the end of the packet
+		err     error
+		asdu    uint32
+		cause   uint32
+		objects []i104mObject
+	}{
+		{"sequence", pktSequenceFloat, 0, nil, 13, 3, []i104mObject{
+			{1001, []byte{0x00, 0x00, 0xf7, 0x42, 0x00}},
+			{1002, []byte{0x00, 0x00, 0xa0, 0xbf, 0x80}},
+		}},
+		{"single", pktSingleSPTB, 0, nil, 30, 3, []i104mObject{
+			{2001, []byte{0x01, 0x98, 0x3a, 0x1e, 0x0c, 0x0f, 0x03, 0x19}},
+		}},
+		{"interrogation confirmation", pktConfirmationGI, 0, nil, 100, 7, []i104mObject{
+			{0, []byte{0x14}},
+		}},
+		{"empty", "", 0, errPacketTooShort, 0, 0, nil},
+		{"signature only", "64646464", 0, errPacketTooShort, 0, 0, nil},
+		{"truncated header", pktSequenceFloat, 28 + 2*9 - 12, errPacketTooShort, 0, 0, nil}, // 12 bytes left
+		{"command signature", pktCommandSingle, 0, errUnknownSignature, 0, 0, nil},
+		{"unknown signature", "01020304" + pktSequenceFloat[8:], 0, errUnknownSignature, 0, 0, nil},
+		{"unknown ASDU", strings.Replace(pktSequenceFloat, "0d000000", "63000000", 1), 0, errUnsupportedASDU, 0, 0, nil},
+		{"sequence truncated object", pktSequenceFloat, 1, errPacketTruncated, 0, 0, nil},
+		{"numpoints over datagram", strings.Replace(pktSequenceFloat, "02000000", "03000000", 1), 0, errPacketTruncated, 0, 0, nil},
+		{"numpoints over maximum size", strings.Replace(pktSequenceFloat, "02000000", "ffffffff", 1), 0, errInvalidPointCount, 0, 0, nil},
+		{"numpoints zero", strings.Replace(pktSequenceFloat, "02000000", "00000000", 1), 0, errInvalidPointCount, 0, 0, nil},
+		{"single truncated", pktSingleSPTB, 1, errPacketTruncated, 0, 0, nil},
+		{"info size without time tag", strings.Replace(pktSingleSPTB, "08000000", "01000000", 1), 0, errInfoSizeMismatch, 0, 0, nil},
+		{"info size over element", strings.Replace(pktSequenceFloat, "05000000", "09000000", 1), 0, errInfoSizeMismatch, 0, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := mustHex(t, tt.packet)
+			pkt, err := decodeI104MPacket(buf[:len(buf)-tt.cut])
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				if pkt != nil {
+					t.Fatalf("packet returned with error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if pkt.asdu != tt.asdu || pkt.commonAddress != 1 || pkt.cause != tt.cause {
+				t.Fatalf("header = ASDU %d, CA %d, cause %d", pkt.asdu, pkt.commonAddress, pkt.cause)
+			}
+			if len(pkt.objects) != len(tt.objects) {
+				t.Fatalf("%d objects, want %d", len(pkt.objects), len(tt.objects))
+			}
+			for i, obj := range pkt.objects {
+				if obj.address != tt.objects[i].address || hex.EncodeToString(obj.info) != hex.EncodeToString(tt.objects[i].info) {
+					t.Errorf("object %d = %d %x, want %d %x", i, obj.address, obj.info, tt.objects[i].address, tt.objects[i].info)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeI104MCommand(t *testing.T) {
+	cmd, err := decodeI104MCommand(mustHex(t, pktCommandSingle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.objectAddress != 3001 || cmd.asdu != 45 || cmd.value != 1 || cmd.sbo || cmd.commonAddress != 1 {
+		t.Fatalf("command = %+v", *cmd)
+	}
+	if _, err := decodeI104MCommand(mustHex(t, pktCommandSingle)[:commandPacketSize-1]); !errors.Is(err, errPacketTooShort) {
+		t.Fatalf("truncated command error = %v", err)
+	}
+	if _, err := decodeI104MCommand(mustHex(t, pktSequenceFloat)); !errors.Is(err, errUnknownSignature) {
+		t.Fatalf("data packet error = %v", err)
+	}
+	if _, err := decodeI104MCommand(mustHex(t, strings.Replace(pktCommandSingle, "2d000000", "1e000000", 1))); !errors.Is(err, errUnsupportedASDU) {
+		t.Fatalf("monitoring ASDU error = %v", err)
+	}
+}
+
+func FuzzDecodeI104MPacket(f *testing.F) {
+	for _, s := range []string{pktSequenceFloat, pktSingleSPTB, pktCommandSingle, pktConfirmationGI} {
+		f.Add(mustHex(f, s))
+	}
+	for _, rec := range readCaptureFile(f, testCaptureFile) {
+		f.Add(rec.data)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		pkt, err := decodeI104MPacket(buf)
+		if err != nil {
+			if pkt != nil {
+				t.Fatalf("packet returned with error %v", err)
+			}
+			return
+		}
+		if len(pkt.objects) == 0 {
+			t.Fatal("no objects without error")
+		}
+		for i, obj := range pkt.objects {
+			// the information elements reference buf, must be within the datagram
+			offset := cap(buf) - cap(obj.info)
+			if offset < packetHeaderSize || offset+len(obj.info) > len(buf) {
+				t.Fatalf("object %d info at %d, %d bytes, out of the %d bytes datagram", i, offset, len(obj.info), len(buf))
+			}
+		}
+	})
+}
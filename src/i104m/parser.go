@@ -0,0 +1,377 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// size of the information element (without the object address) and of its time tag
+type asduLayout struct {
+	infoSize int
+	timeSize int // 0=no time tag, 3=CP24Time2a, 7=CP56Time2a
+}
+
+// layouts of the supported ASDU types
+var asduLayouts = map[uint32]asduLayout{
+	1:  {1, 0}, // single point
+	2:  {1, 3}, // single point with CP24 time tag
+	3:  {1, 0}, // double point
+	4:  {1, 3}, // double point with CP24 time tag
+	5:  {2, 0}, // step position
+	6:  {2, 3}, // step position with CP24 time tag
+	7:  {5, 0}, // bitstring of 32 bits
+	8:  {5, 3}, // bitstring with CP24 time tag
+	9:  {3, 0}, // normalized value
+	10: {3, 3}, // normalized value with CP24 time tag
+	11: {3, 0}, // scaled value
+	12: {3, 3}, // scaled value with CP24 time tag
+	13: {5, 0}, // short float
+	14: {5, 3}, // short float with CP24 time tag
+	15: {5, 0}, // integrated totals
+	16: {5, 3}, // integrated totals with CP24 time tag
+	17: {3, 3}, // event of protection equipment with CP24 time tag
+	18: {4, 3}, // packed start events of protection equipment with CP24 time tag
+	19: {4, 3}, // packed output circuit information of protection equipment with CP24 time tag
+	30: {1, 7}, // single point with CP56 time tag
+	31: {1, 7}, // double point with CP56 time tag
+	32: {2, 7}, // step position with CP56 time tag
+	33: {5, 7}, // bitstring with CP56 time tag
+	34: {3, 7}, // normalized value with CP56 time tag
+	35: {3, 7}, // scaled value with CP56 time tag
+	36: {5, 7}, // short float with CP56 time tag
+	37: {5, 7}, // integrated totals with CP56 time tag
+	38: {3, 7}, // event of protection equipment with CP56 time tag
+	39: {4, 7}, // packed start events of protection equipment with CP56 time tag
+	40: {4, 7}, // packed output circuit information of protection equipment with CP56 time tag
+	45: {1, 0}, // single command
+	46: {1, 0}, // double command
+	47: {1, 0}, // regulating step command
+	48: {3, 0}, // normalized setpoint
+	49: {3, 0}, // scaled setpoint
+	50: {5, 0}, // short float setpoint
+	51: {4, 0}, // bitstring command
+	58: {1, 7}, // single command with CP56 time tag
+	59: {1, 7}, // double command with CP56 time tag
+	60: {1, 7}, // regulating step command with CP56 time tag
+	61: {3, 7}, // normalized setpoint with CP56 time tag
+	62: {3, 7}, // scaled setpoint with CP56 time tag
+	63: {5, 7}, // short float setpoint with CP56 time tag
+	64: {4, 7}, // bitstring command with CP56 time tag
+}
+
+// Decodes a CP56Time2a time tag in the time zone, ok is false when flagged invalid or the day of week
+// (when present) does not match the date. The summer time (SU) bit is applied when summerTime is true.
+func cp56Time(b []byte, loc *time.Location, summerTime bool) (t time.Time, ok bool) {
+	ms := int(binary.LittleEndian.Uint16(b[0:]))
+	year, month, day := 2000+int(b[6]&0x7F), time.Month(b[5]&0x0F), int(b[4]&0x1F)
+	t = time.Date(year, month, day, int(b[3]&0x1F), int(b[2]&0x3F), ms/1000, (ms%1000)*int(time.Millisecond), loc)
+	if summerTime {
+		t = applySummerTime(t, b[3]&0x80 != 0)
+	}
+	ok = b[2]&0x80 == 0
+	if dow := int(b[4] >> 5); dow != 0 && dow != (int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday())+6)%7+1 { // 1=monday
+		ok = false
+	}
+	return t, ok
+}
+
+// Decodes a CP24Time2a time tag (minutes and milliseconds), the hour and date are taken from the receive time.
+// When the result is ahead of the receive time, the time tag is considered from the previous hour.
+func cp24Time(b []byte, received time.Time) (t time.Time, ok bool) {
+	ms := int(binary.LittleEndian.Uint16(b[0:]))
+	t = time.Date(received.Year(), received.Month(), received.Day(), received.Hour(), int(b[2]&0x3F), ms/1000, (ms%1000)*int(time.Millisecond), received.Location())
+	if t.Sub(received) > time.Minute {
+		t = t.Add(-time.Hour)
+	}
+	return t, b[2]&0x80 == 0
+}
+
+// Decodes a CP16Time2a elapsed time (milliseconds)
+func cp16Time(b []byte) uint16 {
+	return binary.LittleEndian.Uint16(b[0:])
+}
+
+// Returns the bits of a bitstring as a JSON array (bit 0 first)
+func bitsJSON(bits uint32) string {
+	arr := make([]int, 32)
+	for i := range arr {
+		arr[i] = int((bits >> i) & 1)
+	}
+	b, _ := json.Marshal(arr)
+	return string(b)
+}
+
+// Returns a JSON object string from a map
+func objJSON(m map[string]interface{}) string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// Parses an information object, preparing the update of realtimeData in oper.
+// For time-tagged digital types also returns the event to be recorded as SOE.
+func i104mParseObj(oper *mongo.UpdateOneModel, buf []byte, objAddr uint32, iecAsdu uint32, cause uint32, commonAddress uint32, protCon *protocolConnection) (ok bool, soe *soeEvent) {
+	var flags byte
+	var value float64
+	var valueString string
+	var valueJSON string
+	var srcTime time.Time
+	var srcTimeQualityOk = false
+	var invalid = false
+	var notTopical = false
+	var blocked = false
+	var substituted = false
+	var overflow = false
+	var transient = false
+	var carry = false
+	var extra bson.D // fields specific to some ASDU types
+
+	if isCommandASDU(iecAsdu) {
+		if !cmdTracker.confirm(commandKey{protCon.ProtocolConnectionNumber, commonAddress, objAddr, iecAsdu}, cause) && logLevel >= logLevelDetailed {
+			log.Printf("Parser - Command ASDU %d address %d with unexpected cause %d", iecAsdu, objAddr, cause)
+		}
+		return false, nil
+	}
+
+	layout, found := asduLayouts[iecAsdu]
+	if !found || len(buf) < layout.infoSize+layout.timeSize {
+		return false, nil
+	}
+
+	// quality descriptor (QDS or QDP)
+	qualityFlags := func(f byte) {
+		invalid = (f & 0x80) == 0x80
+		notTopical = (f & 0x40) == 0x40
+		substituted = (f & 0x20) == 0x20
+		blocked = (f & 0x10) == 0x10
+	}
+
+	ok = true
+	switch iecAsdu {
+	case 9, 10, 11, 12, 34, 35: // normalized, scaled
+		flags = buf[2]
+		qualityFlags(flags)
+		overflow = (flags & 0x01) == 0x01
+		raw := int16(binary.LittleEndian.Uint16(buf[0:]))
+		value = float64(raw)
+		if fullScale := protCon.normalizedFullScale(); fullScale != 0 && (iecAsdu == 9 || iecAsdu == 10 || iecAsdu == 34) {
+			value = value / 32768 * fullScale // -1 to +1 (less one step) of the full scale
+		}
+		value = protCon.scale(commonAddress, objAddr, value)
+		extra = bson.D{{Key: "rawValueAtSource", Value: int(raw)}}
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Analogic %d: %d %f raw %d %d\n", iecAsdu, objAddr, value, raw, flags)
+		}
+	case 5, 6, 32: // step position
+		flags = buf[1]
+		qualityFlags(flags)
+		overflow = (flags & 0x01) == 0x01
+		transient = (buf[0] & 0x80) == 0x80
+		raw := int8(buf[0]<<1) >> 1 // 7 bit signed value
+		value = protCon.scale(commonAddress, objAddr, float64(raw))
+		extra = bson.D{{Key: "rawValueAtSource", Value: int(raw)}}
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		}
+	case 13, 14, 36: // float
+		flags = buf[4]
+		qualityFlags(flags)
+		overflow = (flags & 0x01) == 0x01
+		value = protCon.scale(commonAddress, objAddr, float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[0:]))))
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		}
+	case 7, 8, 33: // bitstring
+		flags = buf[4]
+		qualityFlags(flags)
+		overflow = (flags & 0x01) == 0x01
+		bits := binary.LittleEndian.Uint32(buf[0:])
+		value = float64(bits)
+		valueString = fmt.Sprintf("%d", bits)
+		valueJSON = bitsJSON(bits)
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Bitstring %d: %d %08x %d\n", iecAsdu, objAddr, bits, flags)
+		}
+	case 15, 16, 37: // integrated totals (binary counter reading)
+		flags = buf[4]
+		value = float64(int32(binary.LittleEndian.Uint32(buf[0:])))
+		invalid = (flags & 0x80) == 0x80
+		carry = (flags & 0x20) == 0x20
+		adjusted := (flags & 0x40) == 0x40
+		sequence := int(flags & 0x1F)
+		extra = bson.D{
+			{Key: "adjustedAtSource", Value: adjusted},
+			{Key: "sequenceAtSource", Value: sequence},
+		}
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Counter %d: %d %f seq %d carry %v adjusted %v invalid %v\n", iecAsdu, objAddr, value, sequence, carry, adjusted, invalid)
+		}
+	case 17, 38: // event of protection equipment
+		flags = buf[0]
+		qualityFlags(flags)
+		state := flags & 0x03 // 1=off, 2=on, 0 or 3=indeterminate
+		if state == 0x02 {
+			value = 1
+		}
+		transient = state == 0x00 || state == 0x03
+		elapsed := cp16Time(buf[1:])
+		elapsedInvalid := (flags & 0x08) == 0x08
+		valueJSON = objJSON(map[string]interface{}{"state": state, "elapsedTimeMs": elapsed, "elapsedTimeInvalid": elapsedInvalid})
+		extra = bson.D{
+			{Key: "elapsedTimeAtSource", Value: int(elapsed)},
+			{Key: "elapsedTimeInvalidAtSource", Value: elapsedInvalid},
+		}
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Protection event %d: %d %f elapsed %d ms %d\n", iecAsdu, objAddr, value, elapsed, flags)
+		}
+	case 18, 39: // packed start events of protection equipment
+		flags = buf[1]
+		qualityFlags(flags)
+		spe := buf[0] & 0x3F
+		value = float64(spe)
+		duration := cp16Time(buf[2:])
+		valueJSON = objJSON(map[string]interface{}{
+			"GS": spe&0x01 != 0, "SL1": spe&0x02 != 0, "SL2": spe&0x04 != 0, "SL3": spe&0x08 != 0, "SIE": spe&0x10 != 0, "SRD": spe&0x20 != 0,
+			"relayDurationMs": duration, "elapsedTimeInvalid": flags&0x08 != 0,
+		})
+		extra = bson.D{
+			{Key: "elapsedTimeAtSource", Value: int(duration)},
+			{Key: "elapsedTimeInvalidAtSource", Value: flags&0x08 != 0},
+		}
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Protection start events %d: %d %02x duration %d ms %d\n", iecAsdu, objAddr, spe, duration, flags)
+		}
+	case 19, 40: // packed output circuit information of protection equipment
+		flags = buf[1]
+		qualityFlags(flags)
+		oci := buf[0] & 0x0F
+		value = float64(oci)
+		opTime := cp16Time(buf[2:])
+		valueJSON = objJSON(map[string]interface{}{
+			"GC": oci&0x01 != 0, "CL1": oci&0x02 != 0, "CL2": oci&0x04 != 0, "CL3": oci&0x08 != 0,
+			"relayOperatingTimeMs": opTime, "elapsedTimeInvalid": flags&0x08 != 0,
+		})
+		extra = bson.D{
+			{Key: "elapsedTimeAtSource", Value: int(opTime)},
+			{Key: "elapsedTimeInvalidAtSource", Value: flags&0x08 != 0},
+		}
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Protection output circuits %d: %d %02x operating time %d ms %d\n", iecAsdu, objAddr, oci, opTime, flags)
+		}
+	case 1, 2, 3, 4, 30, 31: // digital
+		// convert qualifiers
+		flags = buf[0]
+		qualityFlags(flags)
+		if iecAsdu == 3 || iecAsdu == 4 || iecAsdu == 31 { // double
+			if flags&0x02 == 0x02 {
+				value = 1
+			} else {
+				value = 0
+			}
+			if flags&0x03 == 0x00 || flags&0x03 == 0x03 {
+				transient = true
+			}
+		} else { // single
+			if flags&0x01 == 0x01 {
+				value = 1
+			} else {
+				value = 0
+			}
+		}
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Digital %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		}
+	default:
+		return false, nil
+	}
+
+	now := time.Now()
+	switch layout.timeSize {
+	case 7:
+		srcTime, srcTimeQualityOk = cp56Time(buf[layout.infoSize:], protCon.location, !protCon.IgnoreSummerTimeBit)
+	case 3:
+		srcTime, srcTimeQualityOk = cp24Time(buf[layout.infoSize:], now.In(protCon.location))
+	}
+	if layout.timeSize > 0 && srcTimeQualityOk && !protCon.timeSkewOk(srcTime, now) {
+		srcTimeQualityOk = false
+		if logLevel >= logLevelDetailed || pointFilter == objAddr {
+			log.Printf("Parser - Time tag of %d off by %s, flagged not ok.", objAddr, now.Sub(srcTime).Round(time.Millisecond))
+		}
+	}
+	if valueString == "" {
+		valueString = fmt.Sprintf("%f", value)
+	}
+
+	oper.SetFilter(protCon.sourceFilter(commonAddress, objAddr))
+
+	update := bson.D{
+		{Key: "valueAtSource", Value: value},
+		{Key: "valueStringAtSource", Value: valueString},
+	}
+	if valueJSON != "" {
+		update = append(update, bson.E{Key: "valueJsonAtSource", Value: valueJSON})
+	}
+	update = append(update, bson.D{
+		{Key: "invalidAtSource", Value: invalid},
+		{Key: "notTopicalAtSource", Value: notTopical},
+		{Key: "substitutedAtSource", Value: substituted},
+		{Key: "blockedAtSource", Value: blocked},
+		{Key: "overflowAtSource", Value: overflow},
+		{Key: "transientAtSource", Value: transient},
+		{Key: "carryAtSource", Value: carry},
+		{Key: "asduAtSource", Value: fmt.Sprintf("%d", iecAsdu)},
+		{Key: "causeOfTransmissionAtSource", Value: cause},
+		{Key: "timeTag", Value: now},
+	}...)
+	update = append(update, extra...)
+	if layout.timeSize > 0 {
+		update = append(update, bson.D{
+			{Key: "timeTagAtSource", Value: srcTime},
+			{Key: "timeTagAtSourceOk", Value: srcTimeQualityOk},
+		}...)
+	} else {
+		update = append(update, bson.E{Key: "timeTagAtSourceOk", Value: false})
+	}
+	if isSOEASDU(iecAsdu) {
+		// the driver records the event in soeData, so that all events of a packet are kept
+		update = append(update, bson.E{Key: "soeRecorded", Value: true})
+		soe = &soeEvent{
+			conn:              protCon,
+			commonAddress:     commonAddress,
+			objectAddress:     objAddr,
+			value:             value,
+			invalid:           invalid,
+			cause:             cause,
+			timeTag:           now,
+			timeTagAtSource:   srcTime,
+			timeTagAtSourceOk: srcTimeQualityOk,
+		}
+	}
+	oper.SetUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "sourceDataUpdate", Value: update}}}})
+
+	return ok, soe
+}
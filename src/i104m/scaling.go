@@ -0,0 +1,137 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const scalingRefresh = time.Minute // period to reload the scaling of the points
+
+// linear scaling of a point, from the tag
+type pointScale struct {
+	factor float64
+	offset float64
+}
+
+// scaleCache keeps the scaling of the points of a connection by address, points without scaling are not listed
+type scaleCache struct {
+	mu     sync.Mutex
+	scales map[pointAddress]*pointScale
+}
+
+// Returns the full scale of normalized values, zero when normalized values are kept raw
+func (protCon *protocolConnection) normalizedFullScale() float64 {
+	switch {
+	case protCon.NormalizedFullScale < 0:
+		return 0
+	case protCon.NormalizedFullScale == 0:
+		return 1
+	}
+	return protCon.NormalizedFullScale
+}
+
+// Reads from realtimeData the scaling of all points of the connection, replacing the cache
+func (protCon *protocolConnection) loadScaling(collection *mongo.Collection) error {
+	filter := bson.D{
+		{Key: "protocolSourceConnectionNumber", Value: protCon.ProtocolConnectionNumber},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "protocolSourceScaleFactor", Value: bson.D{{Key: "$exists", Value: true}}}},
+			bson.D{{Key: "protocolSourceScaleOffset", Value: bson.D{{Key: "$exists", Value: true}}}},
+		}},
+	}
+	projection := bson.D{
+		{Key: "protocolSourceCommonAddress", Value: 1},
+		{Key: "protocolSourceObjectAddress", Value: 1},
+		{Key: "protocolSourceScaleFactor", Value: 1},
+		{Key: "protocolSourceScaleOffset", Value: 1},
+	}
+	cursor, err := collection.Find(context.TODO(), filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	scales := make(map[pointAddress]*pointScale)
+	for cursor.Next(context.TODO()) {
+		var pt struct {
+			ProtocolSourceCommonAddress interface{} `bson:"protocolSourceCommonAddress"`
+			ProtocolSourceObjectAddress interface{} `bson:"protocolSourceObjectAddress"`
+			ProtocolSourceScaleFactor   float64     `bson:"protocolSourceScaleFactor"`
+			ProtocolSourceScaleOffset   float64     `bson:"protocolSourceScaleOffset"`
+		}
+		if err := cursor.Decode(&pt); err != nil {
+			log.Printf("Scaling - Error decoding scaling of point: %v", err)
+			continue
+		}
+		addr, ok := toUint32(pt.ProtocolSourceObjectAddress)
+		if !ok {
+			continue
+		}
+		ca, _ := toUint32(pt.ProtocolSourceCommonAddress)
+		scale := &pointScale{factor: pt.ProtocolSourceScaleFactor, offset: pt.ProtocolSourceScaleOffset}
+		if scale.factor == 0 {
+			scale.factor = 1
+		}
+		scales[protCon.pointAddress(ca, addr)] = scale
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	c := protCon.scaling
+	c.mu.Lock()
+	c.scales = scales
+	c.mu.Unlock()
+	if logLevel >= logLevelDetailed {
+		log.Printf("Scaling - Connection %d loaded scaling of %d points", protCon.ProtocolConnectionNumber, len(scales))
+	}
+	return nil
+}
+
+// Reloads the scaling of the points of the connections periodically, runs forever.
+// The cache is replaced at once, so the processing of packets never waits for the database.
+func refreshScaling(connections []*protocolConnection, collection *mongo.Collection) {
+	for range time.Tick(scalingRefresh) {
+		for _, conn := range connections {
+			if err := conn.loadScaling(collection); err != nil {
+				log.Printf("Scaling - Connection %d error reading scaling of points: %v", conn.ProtocolConnectionNumber, err)
+			}
+		}
+	}
+}
+
+// Applies the scaling of the point to a value
+func (protCon *protocolConnection) scale(commonAddress uint32, objAddr uint32, value float64) float64 {
+	c := protCon.scaling
+	c.mu.Lock()
+	s := c.scales[protCon.pointAddress(commonAddress, objAddr)]
+	c.mu.Unlock()
+	if s == nil {
+		return value
+	}
+	return value*s.factor + s.offset
+}
@@ -0,0 +1,592 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultIntegrityInterval = 300 * time.Second // period of integrity sends of server connections
+	cotSpontaneous           = 3                 // cause of transmission: spontaneous
+	cotInterrogated          = 20                // cause of transmission: interrogated by station interrogation
+	cotNegative              = 0x40              // negative confirmation bit of the cause of transmission
+)
+
+// protocol destination of a point, for server connections
+type protocolDestination struct {
+	ConnectionNumber float64     `json:"protocolDestinationConnectionNumber" bson:"protocolDestinationConnectionNumber"`
+	CommonAddress    interface{} `json:"protocolDestinationCommonAddress" bson:"protocolDestinationCommonAddress"`
+	ObjectAddress    interface{} `json:"protocolDestinationObjectAddress" bson:"protocolDestinationObjectAddress"`
+	ASDU             interface{} `json:"protocolDestinationASDU" bson:"protocolDestinationASDU"`
+	KConv1           float64     `json:"protocolDestinationKConv1" bson:"protocolDestinationKConv1"`
+	KConv2           float64     `json:"protocolDestinationKConv2" bson:"protocolDestinationKConv2"`
+}
+
+// realtimeData point as read by server connections
+type rtPoint struct {
+	ID                             float64               `json:"_id" bson:"_id"`
+	Tag                            string                `json:"tag" bson:"tag"`
+	Type                           string                `json:"type" bson:"type"`
+	Origin                         string                `json:"origin" bson:"origin"`
+	Group1                         string                `json:"group1" bson:"group1"`
+	Value                          float64               `json:"value" bson:"value"`
+	Invalid                        bool                  `json:"invalid" bson:"invalid"`
+	TimeTagAtSource                *time.Time            `json:"timeTagAtSource" bson:"timeTagAtSource"`
+	TimeTagAtSourceOk              bool                  `json:"timeTagAtSourceOk" bson:"timeTagAtSourceOk"`
+	ProtocolSourceConnectionNumber float64               `json:"protocolSourceConnectionNumber" bson:"protocolSourceConnectionNumber"`
+	ProtocolSourceCommonAddress    interface{}           `json:"protocolSourceCommonAddress" bson:"protocolSourceCommonAddress"`
+	ProtocolSourceObjectAddress    interface{}           `json:"protocolSourceObjectAddress" bson:"protocolSourceObjectAddress"`
+	ProtocolSourceASDU             interface{}           `json:"protocolSourceASDU" bson:"protocolSourceASDU"`
+	ProtocolSourceCommandDuration  float64               `json:"protocolSourceCommandDuration" bson:"protocolSourceCommandDuration"`
+	ProtocolSourceCommandUseSBO    bool                  `json:"protocolSourceCommandUseSBO" bson:"protocolSourceCommandUseSBO"`
+	ProtocolDestinations           []protocolDestination `json:"protocolDestinations" bson:"protocolDestinations"`
+}
+
+type rtChange struct {
+	FullDocument  rtPoint `json:"fullDocument" bson:"fullDocument"`
+	OperationType string  `json:"operationType" bson:"operationType"`
+}
+
+// address of a point published by a server connection
+type publishedPoint struct {
+	tag           string
+	commonAddress uint32
+	objectAddress uint32
+	asdu          uint32 // ASDU type of spontaneous sends, integrity sends use the type without time tag
+	kconv1        float64
+	kconv2        float64
+}
+
+// address of a command received by a server connection
+type commandAddress struct {
+	commonAddress uint32
+	objectAddress uint32
+}
+
+// publisher sends realtimeData changes of a server connection as I104M packets
+type publisher struct {
+	conn          *protocolConnection
+	mu            sync.Mutex
+	points        map[int]*publishedPoint    // by point key
+	commands      map[commandAddress]rtPoint // command points by destination address
+	interrogation chan struct{}              // general interrogations requested by the destinations
+}
+
+// IEC 60870-5-104 names of monitoring ASDU types
+var monitoringASDUNames = map[string]uint32{
+	"M_SP_NA_1": 1, "M_SP_TA_1": 2, "M_DP_NA_1": 3, "M_DP_TA_1": 4, "M_ST_NA_1": 5, "M_ST_TA_1": 6, "M_BO_NA_1": 7, "M_BO_TA_1": 8,
+	"M_ME_NA_1": 9, "M_ME_TA_1": 10, "M_ME_NB_1": 11, "M_ME_TB_1": 12, "M_ME_NC_1": 13, "M_ME_TC_1": 14, "M_IT_NA_1": 15, "M_IT_TA_1": 16,
+	"M_SP_TB_1": 30, "M_DP_TB_1": 31, "M_ST_TB_1": 32, "M_BO_TB_1": 33, "M_ME_TD_1": 34, "M_ME_TE_1": 35, "M_ME_TF_1": 36, "M_IT_TB_1": 37,
+}
+
+// ASDU types without time tag of the types with CP56 time tag, used for integrity sends
+var asduWithoutTime = map[uint32]uint32{2: 1, 4: 3, 6: 5, 8: 7, 10: 9, 12: 11, 14: 13, 16: 15, 30: 1, 31: 3, 32: 5, 33: 7, 34: 9, 35: 11, 36: 13, 37: 15}
+
+// Converts a number or numeric string from the database to uint32
+func toUint32(v interface{}) (uint32, bool) {
+	switch val := v.(type) {
+	case int32:
+		return uint32(val), val >= 0
+	case int64:
+		return uint32(val), val >= 0 && val <= math.MaxUint32
+	case float64:
+		return uint32(val), val >= 0 && val <= math.MaxUint32
+	case string:
+		n, err := strconv.ParseUint(strings.TrimSpace(val), 10, 32)
+		return uint32(n), err == nil
+	}
+	return 0, false
+}
+
+// Parses a monitoring ASDU type that can be published, as a number, a numeric string or an IEC name (e.g. "M_ME_TF_1")
+func parseMonitoringASDU(v interface{}) (uint32, bool) {
+	if s, ok := v.(string); ok {
+		if n, found := monitoringASDUNames[strings.ToUpper(strings.TrimSpace(s))]; found {
+			return n, true
+		}
+	}
+	asdu, ok := toUint32(v)
+	if !ok || (asdu > 16 && asdu < 30) || asdu > 37 || asdu == 0 {
+		return 0, false
+	}
+	return asdu, true
+}
+
+// Returns the time tag as CP56Time2a in the time zone of t (summer time flagged), flagged invalid when not ok
+func encodeCP56Time(t time.Time, ok bool) []byte {
+	ms := t.Second()*1000 + t.Nanosecond()/int(time.Millisecond)
+	b := make([]byte, 7)
+	binary.LittleEndian.PutUint16(b[0:], uint16(ms))
+	b[2] = byte(t.Minute())
+	if !ok {
+		b[2] |= 0x80
+	}
+	b[3] = byte(t.Hour())
+	if t.IsDST() {
+		b[3] |= 0x80
+	}
+	b[4] = byte(t.Day()) | byte(((int(t.Weekday())+6)%7+1)<<5) // day of week, 1=monday
+	b[5] = byte(t.Month())
+	b[6] = byte(t.Year() % 100)
+	return b
+}
+
+// Returns the time tag as CP24Time2a (minutes and milliseconds), flagged invalid when not ok
+func encodeCP24Time(t time.Time, ok bool) []byte {
+	return encodeCP56Time(t, ok)[:3]
+}
+
+// Encodes the information element (with time tag) of a value, according to the monitoring ASDU type.
+// Normalized values are encoded relative to fullScale (0 to encode the raw value).
+func encodeInfoElement(asdu uint32, value float64, invalid bool, t time.Time, timeOk bool, fullScale float64) ([]byte, error) {
+	layout, found := asduLayouts[asdu]
+	if !found {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedASDU, asdu)
+	}
+	var qds byte
+	if invalid || math.IsNaN(value) {
+		qds = 0x80
+		if math.IsNaN(value) {
+			value = 0
+		}
+	}
+	// limits value to the range, setting the overflow flag when out of range
+	clamp := func(min, max float64) float64 {
+		v := math.Round(value)
+		if v < min || v > max {
+			qds |= 0x01
+			v = math.Max(min, math.Min(max, v))
+		}
+		return v
+	}
+
+	b := make([]byte, layout.infoSize, layout.infoSize+layout.timeSize)
+	switch asdu {
+	case 1, 2, 30: // single point
+		b[0] = qds &^ 0x01
+		if value != 0 {
+			b[0] |= 0x01
+		}
+	case 3, 4, 31: // double point, 1=off, 2=on
+		b[0] = qds&^0x01 | 0x01
+		if value != 0 {
+			b[0] = qds&^0x01 | 0x02
+		}
+	case 5, 6, 32: // step position, 7 bit signed value
+		v := clamp(-64, 63)
+		b[0] = byte(int8(v)) & 0x7F
+		b[1] = qds
+	case 7, 8, 33: // bitstring of 32 bits
+		binary.LittleEndian.PutUint32(b[0:], uint32(clamp(0, math.MaxUint32)))
+		b[4] = qds
+	case 9, 10, 34: // normalized, -1 to +1 of the full scale as value/fullScale*32768 (inverse of the parser)
+		if fullScale != 0 {
+			value = value / fullScale * 32768
+			if value > math.MaxInt16 && value <= 32768 { // +1 of the full scale is the maximum normalized value (1-2^-15)
+				value = math.MaxInt16
+			}
+		}
+		binary.LittleEndian.PutUint16(b[0:], uint16(int16(clamp(math.MinInt16, math.MaxInt16))))
+		b[2] = qds
+	case 11, 12, 35: // scaled
+		binary.LittleEndian.PutUint16(b[0:], uint16(int16(clamp(math.MinInt16, math.MaxInt16))))
+		b[2] = qds
+	case 13, 14, 36: // short float
+		if math.Abs(value) > math.MaxFloat32 {
+			qds |= 0x01
+		}
+		binary.LittleEndian.PutUint32(b[0:], math.Float32bits(float32(value)))
+		b[4] = qds
+	case 15, 16, 37: // integrated totals, only the invalid flag of the qualifier
+		binary.LittleEndian.PutUint32(b[0:], uint32(int32(clamp(math.MinInt32, math.MaxInt32))))
+		b[4] = qds & 0x80
+	default:
+		return nil, fmt.Errorf("%w: %d", errUnsupportedASDU, asdu)
+	}
+
+	switch layout.timeSize {
+	case 7:
+		b = append(b, encodeCP56Time(t, timeOk)...)
+	case 3:
+		b = append(b, encodeCP24Time(t, timeOk)...)
+	}
+	return b, nil
+}
+
+// Decodes the 32 bit value field of a command packet according to the command ASDU type (inverse of encodeCommandValue)
+func decodeCommandValue(asdu uint32, raw uint32) float64 {
+	switch asdu {
+	case 48, 61: // normalized setpoint
+		return float64(int16(raw)) / 32768
+	case 49, 62: // scaled setpoint
+		return float64(int16(raw))
+	case 50, 63: // short float setpoint
+		return float64(math.Float32frombits(raw))
+	case 51, 64: // bitstring
+		return float64(raw)
+	}
+	return float64(raw & 0x01) // single (SCS), double and regulating step commands (0/1 on I104M, not the IEC DCS/RCS 1/2)
+}
+
+// Returns the time to wait between integrity sends, zero when disabled
+func (protCon *protocolConnection) integrityInterval() time.Duration {
+	switch {
+	case protCon.IntegrityInterval < 0:
+		return 0
+	case protCon.IntegrityInterval == 0:
+		return defaultIntegrityInterval
+	}
+	return time.Duration(protCon.IntegrityInterval * float64(time.Second))
+}
+
+// Returns the address to publish the point on the connection, nil if the point is not published
+func (protCon *protocolConnection) publishedAddress(pt *rtPoint) *publishedPoint {
+	for _, dest := range pt.ProtocolDestinations {
+		if int(dest.ConnectionNumber) != protCon.ProtocolConnectionNumber {
+			continue
+		}
+		ca, _ := toUint32(dest.CommonAddress)
+		addr, okAddr := toUint32(dest.ObjectAddress)
+		asdu, okAsdu := parseMonitoringASDU(dest.ASDU)
+		if !okAddr || !okAsdu {
+			return nil
+		}
+		return &publishedPoint{tag: pt.Tag, commonAddress: ca, objectAddress: addr, asdu: asdu, kconv1: dest.KConv1, kconv2: dest.KConv2}
+	}
+
+	// points of the groups in topics are published with the point key as the object address
+	if pt.Origin == "command" || !contains(protCon.Topics, pt.Group1) {
+		return nil
+	}
+	asdu := uint32(36) // float with time tag
+	if pt.Type == "digital" {
+		asdu = 30 // single point with time tag
+	}
+	return &publishedPoint{tag: pt.Tag, objectAddress: uint32(pt.ID), asdu: asdu}
+}
+
+// Returns the command point address on the connection, false if the point is not a command of the connection
+func (protCon *protocolConnection) commandAddress(pt *rtPoint) (commandAddress, bool) {
+	for _, dest := range pt.ProtocolDestinations {
+		if int(dest.ConnectionNumber) != protCon.ProtocolConnectionNumber {
+			continue
+		}
+		ca, _ := toUint32(dest.CommonAddress)
+		addr, okAddr := toUint32(dest.ObjectAddress)
+		if _, err := parseCommandASDU(dest.ASDU); err != nil || !okAddr {
+			return commandAddress{}, false
+		}
+		return commandAddress{ca, addr}, true
+	}
+	return commandAddress{}, false
+}
+
+// Returns the filter of realtimeData points of server connections, prefix is prepended to the field names
+func publishedFilter(conns []*protocolConnection, prefix string) bson.D {
+	var numbers []int
+	var topics []string
+	for _, conn := range conns {
+		numbers = append(numbers, conn.ProtocolConnectionNumber)
+		topics = append(topics, conn.Topics...)
+	}
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: prefix + "protocolDestinations.protocolDestinationConnectionNumber", Value: bson.D{{Key: "$in", Value: numbers}}}},
+		bson.D{{Key: prefix + "group1", Value: bson.D{{Key: "$in", Value: topics}}}},
+	}}}
+}
+
+// Reads the points published by the server connection, returns the points read
+func (p *publisher) load(collection *mongo.Collection) ([]rtPoint, error) {
+	cursor, err := collection.Find(context.TODO(), publishedFilter([]*protocolConnection{p.conn}, ""))
+	if err != nil {
+		return nil, err
+	}
+	var list []rtPoint
+	if err = cursor.All(context.TODO(), &list); err != nil {
+		return nil, err
+	}
+
+	points := make(map[int]*publishedPoint)
+	commands := make(map[commandAddress]rtPoint)
+	for i := range list {
+		if addr, ok := p.conn.commandAddress(&list[i]); ok {
+			commands[addr] = list[i]
+		} else if pp := p.conn.publishedAddress(&list[i]); pp != nil {
+			points[int(list[i].ID)] = pp
+		}
+	}
+	p.mu.Lock()
+	p.points = points
+	p.commands = commands
+	p.mu.Unlock()
+	if logLevel >= logLevelDetailed {
+		log.Printf("Server - Connection %d publishing %d points, %d commands.", p.conn.ProtocolConnectionNumber, len(points), len(commands))
+	}
+	return list, nil
+}
+
+// Sends a packet to all destinations of the server connection
+func (p *publisher) send(buf []byte) {
+	buf = p.conn.sign(buf)
+	for _, ipAddressDest := range p.conn.destinations() {
+		if err := p.conn.send(buf, ipAddressDest); err != nil {
+			log.Println("Server - Error on IP: ", err)
+		}
+	}
+}
+
+// Encodes the point value for the published address, with the conversion factors applied
+func (pp *publishedPoint) encode(asdu uint32, pt *rtPoint, conn *protocolConnection) ([]byte, error) {
+	value := pt.Value
+	if pp.kconv1 != 0 {
+		value = value*pp.kconv1 + pp.kconv2
+	}
+	t := time.Now()
+	timeOk := false
+	if pt.TimeTagAtSource != nil {
+		t = *pt.TimeTagAtSource
+		timeOk = pt.TimeTagAtSourceOk
+	}
+	return encodeInfoElement(asdu, value, pt.Invalid, t.In(conn.location), timeOk, conn.normalizedFullScale())
+}
+
+// Sends a point change as a single packet (spontaneous)
+func (p *publisher) publish(pt *rtPoint) {
+	p.mu.Lock()
+	pp := p.points[int(pt.ID)]
+	p.mu.Unlock()
+	if pp == nil {
+		return
+	}
+	info, err := pp.encode(pp.asdu, pt, p.conn)
+	if err != nil {
+		log.Printf("Server - Point %s not published: %v", pt.Tag, err)
+		return
+	}
+	p.send(encodeI104MSingle(pp.asdu, pp.commonAddress, cotSpontaneous, i104mObject{address: pp.objectAddress, info: info}))
+	if logLevel >= logLevelDetailed || pointFilter == pp.objectAddress {
+		log.Printf("Server - Connection %d sent %s %d %d %f", p.conn.ProtocolConnectionNumber, pt.Tag, pp.asdu, pp.objectAddress, pt.Value)
+	}
+}
+
+// Sends all points of the connection as sequence packets (integrity), grouped by common address and ASDU type
+func (p *publisher) integrity(list []rtPoint) {
+	type group struct {
+		commonAddress uint32
+		asdu          uint32
+	}
+	groups := make(map[group][]i104mObject)
+	var order []group
+	p.mu.Lock()
+	for i := range list {
+		pp := p.points[int(list[i].ID)]
+		if pp == nil {
+			continue
+		}
+		asdu := pp.asdu
+		if a, ok := asduWithoutTime[asdu]; ok {
+			asdu = a
+		}
+		info, err := pp.encode(asdu, &list[i], p.conn)
+		if err != nil {
+			continue
+		}
+		g := group{pp.commonAddress, asdu}
+		if _, ok := groups[g]; !ok {
+			order = append(order, g)
+		}
+		groups[g] = append(groups[g], i104mObject{address: pp.objectAddress, info: info})
+	}
+	p.mu.Unlock()
+
+	cnt := 0
+	for _, g := range order {
+		for _, buf := range encodeI104MSequence(g.asdu, g.commonAddress, cotInterrogated, groups[g]) {
+			p.send(buf)
+			cnt++
+		}
+	}
+	if logLevel >= logLevelBasic {
+		log.Printf("Server - Connection %d integrity sent, %d packets.", p.conn.ProtocolConnectionNumber, cnt)
+	}
+}
+
+// Reloads the points and sends integrity periodically, runs forever
+func (p *publisher) runIntegrity(collection *mongo.Collection) {
+	for {
+		list, err := p.load(collection)
+		if err != nil {
+			log.Printf("Server - Error reading points of connection %d: %v", p.conn.ProtocolConnectionNumber, err)
+		} else if isActive {
+			p.integrity(list)
+		}
+		interval := p.conn.integrityInterval()
+		if interval == 0 { // wait for a general interrogation
+			<-p.interrogation
+			continue
+		}
+		select {
+		case <-p.interrogation:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Processes an interrogation or clock synchronization request.
+// A general interrogation anticipates the integrity send, the other requests are only confirmed.
+func (p *publisher) systemCommand(cmd *i104mCommand, source string) {
+	if cmd.asdu == asduInterrogation {
+		select {
+		case p.interrogation <- struct{}{}:
+		default: // an interrogation is already pending
+		}
+	}
+	if logLevel >= logLevelBasic {
+		log.Printf("Server - Connection %d request ASDU %d from %s.", p.conn.ProtocolConnectionNumber, cmd.asdu, source)
+	}
+}
+
+// Processes a command packet received by the server connection, inserting the command in commandsQueue.
+// An activation confirmation (negative when refused) is sent back to the origin.
+func (p *publisher) command(buf []byte, source string, collectionCommands *mongo.Collection) {
+	cmd, err := decodeI104MCommand(buf)
+	if err != nil {
+		cntRejectedPackets.Add(1)
+		p.conn.stats.packetsRejected.Add(1)
+		if logLevel >= logLevelBasic {
+			log.Printf("Server - Invalid command from %s rejected: %v", source, err)
+		}
+		return
+	}
+
+	p.conn.stats.packetsAccepted.Add(1)
+
+	p.mu.Lock()
+	pt, found := p.commands[commandAddress{cmd.commonAddress, cmd.objectAddress}]
+	p.mu.Unlock()
+
+	cause := uint32(cotActivationCon)
+	switch {
+	case isSystemCommandASDU(cmd.asdu):
+		p.systemCommand(cmd, source)
+	case !p.conn.CommandsEnabled:
+		log.Printf("Server - Command from %s refused, commands disabled on connection %d.", source, p.conn.ProtocolConnectionNumber)
+		cause |= cotNegative
+	case !found:
+		log.Printf("Server - Command from %s refused, no command point for address %d CA %d.", source, cmd.objectAddress, cmd.commonAddress)
+		cause |= cotNegative
+	default:
+		value := decodeCommandValue(cmd.asdu, cmd.value)
+		_, err = collectionCommands.InsertOne(context.TODO(), bson.M{
+			"protocolSourceConnectionNumber": pt.ProtocolSourceConnectionNumber,
+			"protocolSourceCommonAddress":    pt.ProtocolSourceCommonAddress,
+			"protocolSourceObjectAddress":    pt.ProtocolSourceObjectAddress,
+			"protocolSourceASDU":             pt.ProtocolSourceASDU,
+			"protocolSourceCommandDuration":  pt.ProtocolSourceCommandDuration,
+			"protocolSourceCommandUseSBO":    pt.ProtocolSourceCommandUseSBO,
+			"pointKey":                       pt.ID,
+			"tag":                            pt.Tag,
+			"value":                          value,
+			"valueString":                    strconv.FormatFloat(value, 'f', -1, 64),
+			"originatorUserName":             fmt.Sprintf("Protocol connection: %d %s", p.conn.ProtocolConnectionNumber, p.conn.Name),
+			"originatorIpAddress":            sourceIP(source),
+			"timeTag":                        time.Now(),
+		})
+		if err != nil {
+			log.Printf("Server - Command %s not inserted: %v", pt.Tag, err)
+			cause |= cotNegative
+		} else {
+			log.Printf("Server - Command %s %f from %s inserted.", pt.Tag, value, source)
+		}
+	}
+
+	// confirmation with the command value echoed
+	layout, ok := asduLayouts[cmd.asdu]
+	if !ok {
+		layout = systemCommandLayouts[cmd.asdu]
+	}
+	info := make([]byte, 4, layout.infoSize+layout.timeSize+4)
+	binary.LittleEndian.PutUint32(info, cmd.value)
+	info = info[:layout.infoSize]
+	if layout.timeSize > 0 {
+		info = append(info, encodeCP56Time(time.Now().In(p.conn.location), true)...)
+	}
+	if err := p.conn.send(p.conn.sign(encodeI104MSingle(cmd.asdu, cmd.commonAddress, cause, i104mObject{address: cmd.objectAddress, info: info})), source); err != nil {
+		log.Println("Server - Error sending command confirmation: ", err)
+	}
+}
+
+// Watches realtimeData changes of the points published by server connections, runs forever
+func watchPublishedPoints(collection *mongo.Collection, publishers []*publisher) {
+	var conns []*protocolConnection
+	for _, p := range publishers {
+		conns = append(conns, p.conn)
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: bson.D{{Key: "$in", Value: bson.A{"update", "replace"}}}}}}},
+		bson.D{{Key: "$match", Value: publishedFilter(conns, "fullDocument.")}},
+		// only changes of value or quality (not sourceDataUpdate written by protocol drivers before the data processor)
+		bson.D{{Key: "$match", Value: bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "operationType", Value: "replace"}},
+			bson.D{{Key: "updateDescription.updatedFields.value", Value: bson.D{{Key: "$exists", Value: true}}}},
+			bson.D{{Key: "updateDescription.updatedFields.invalid", Value: bson.D{{Key: "$exists", Value: true}}}},
+			bson.D{{Key: "updateDescription.updatedFields.timeTagAtSource", Value: bson.D{{Key: "$exists", Value: true}}}},
+		}}}}},
+	}
+
+	for {
+		cs, err := collection.Watch(context.TODO(), pipeline, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+		if err != nil {
+			log.Printf("Server - Error watching realtimeData: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for cs.Next(context.TODO()) {
+			var change rtChange
+			if err := cs.Decode(&change); err != nil {
+				log.Printf("Server - Error: %v", err)
+				continue
+			}
+			if !isActive {
+				continue
+			}
+			for _, p := range publishers {
+				p.publish(&change.FullDocument)
+			}
+		}
+		if err := cs.Err(); err != nil {
+			log.Printf("Server - Changestream error: %v", err)
+		}
+		cs.Close(context.TODO())
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const soePointsRefresh = 5 * time.Minute // period to reload the points of SOE events
+
+// time-tagged digital change parsed, to be recorded in the soeData collection
+type soeEvent struct {
+	conn              *protocolConnection
+	commonAddress     uint32
+	objectAddress     uint32
+	value             float64
+	invalid           bool
+	cause             uint32
+	timeTag           time.Time
+	timeTagAtSource   time.Time
+	timeTagAtSourceOk bool
+}
+
+// realtimeData fields needed for SOE records
+type soePoint struct {
+	ID             float64 `json:"_id" bson:"_id"`
+	Tag            string  `json:"tag" bson:"tag"`
+	Type           string  `json:"type" bson:"type"`
+	Group1         string  `json:"group1" bson:"group1"`
+	Description    string  `json:"description" bson:"description"`
+	EventTextTrue  string  `json:"eventTextTrue" bson:"eventTextTrue"`
+	EventTextFalse string  `json:"eventTextFalse" bson:"eventTextFalse"`
+	Priority       float64 `json:"priority" bson:"priority"`
+	IsEvent        bool    `json:"isEvent" bson:"isEvent"`
+	AlarmDisabled  bool    `json:"alarmDisabled" bson:"alarmDisabled"`
+	KConv1         float64 `json:"kconv1" bson:"kconv1"`
+}
+
+func (ev *soeEvent) address() pointAddress {
+	return ev.conn.pointAddress(ev.commonAddress, ev.objectAddress)
+}
+
+// soeRecorder writes SOE events to the soeData collection, caching the points by address
+type soeRecorder struct {
+	mu             sync.Mutex
+	collectionRTD  *mongo.Collection
+	collectionSOE  *mongo.Collection
+	points         map[pointAddress]*soePoint // nil for addresses without a point
+	pointsReloaded time.Time
+}
+
+// Returns true for the ASDU types recorded as SOE (digital with time tag)
+func isSOEASDU(iecAsdu uint32) bool {
+	return iecAsdu == 2 || iecAsdu == 4 || iecAsdu == 30 || iecAsdu == 31
+}
+
+// Returns the points of the event addresses, reading from realtimeData the addresses not cached
+func (r *soeRecorder) lookup(events []*soeEvent) map[pointAddress]*soePoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.points == nil || time.Since(r.pointsReloaded) > soePointsRefresh {
+		r.points = make(map[pointAddress]*soePoint)
+		r.pointsReloaded = time.Now()
+	}
+
+	// addresses not cached, grouped by connection and common address
+	type source struct {
+		conn          *protocolConnection
+		commonAddress uint32
+	}
+	missing := make(map[source][]uint32)
+	for _, ev := range events {
+		addr := ev.address()
+		if _, found := r.points[addr]; !found {
+			r.points[addr] = nil
+			src := source{ev.conn, addr.commonAddress}
+			missing[src] = append(missing[src], ev.objectAddress)
+		}
+	}
+	for src, addrs := range missing {
+		cursor, err := r.collectionRTD.Find(context.TODO(), src.conn.sourceFilter(src.commonAddress, bson.D{{Key: "$in", Value: addrs}}))
+		if err != nil {
+			log.Printf("SOE - Error reading points: %v", err)
+			continue
+		}
+		for cursor.Next(context.TODO()) {
+			var pt struct {
+				soePoint                    `bson:",inline"`
+				ProtocolSourceObjectAddress interface{} `bson:"protocolSourceObjectAddress"`
+			}
+			if err := cursor.Decode(&pt); err != nil {
+				log.Printf("SOE - Error decoding point: %v", err)
+				continue
+			}
+			if addr, ok := toUint32(pt.ProtocolSourceObjectAddress); ok {
+				p := pt.soePoint
+				r.points[pointAddress{src.conn.ProtocolConnectionNumber, src.commonAddress, addr}] = &p
+			}
+		}
+		cursor.Close(context.TODO())
+	}
+
+	points := make(map[pointAddress]*soePoint, len(events))
+	for _, ev := range events {
+		addr := ev.address()
+		points[addr] = r.points[addr]
+	}
+	return points
+}
+
+// Inserts in soeData all the events of a packet, following the same rules of the data processor
+// (alarm disabled points and the off state of event points are not recorded)
+func (r *soeRecorder) record(events []*soeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	points := r.lookup(events)
+
+	var docs []interface{}
+	for _, ev := range events {
+		pt := points[ev.address()]
+		if pt == nil || pt.Type == "analog" || pt.AlarmDisabled {
+			continue
+		}
+		value := ev.value
+		if pt.KConv1 == -1 { // inverted state
+			value = 1 - value
+		}
+		if value == 0 && pt.IsEvent {
+			continue
+		}
+		eventText := pt.EventTextFalse
+		if value != 0 {
+			eventText = pt.EventTextTrue
+		}
+		docs = append(docs, bson.D{
+			{Key: "tag", Value: pt.Tag},
+			{Key: "pointKey", Value: pt.ID},
+			{Key: "group1", Value: pt.Group1},
+			{Key: "description", Value: pt.Description},
+			{Key: "eventText", Value: eventText},
+			{Key: "invalid", Value: ev.invalid},
+			{Key: "priority", Value: pt.Priority},
+			{Key: "timeTag", Value: ev.timeTag},
+			{Key: "timeTagAtSource", Value: ev.timeTagAtSource},
+			{Key: "timeTagAtSourceOk", Value: ev.timeTagAtSourceOk},
+			{Key: "ack", Value: int32(0)},
+			{Key: "value", Value: value},
+			{Key: "causeOfTransmissionAtSource", Value: ev.cause},
+		})
+		if logLevel >= logLevelDetailed || pointFilter == ev.objectAddress {
+			log.Printf("SOE - %s %f %s", pt.Tag, value, ev.timeTagAtSource.Format(time.RFC3339Nano))
+		}
+	}
+	if len(docs) == 0 {
+		return
+	}
+	if _, err := r.collectionSOE.InsertMany(context.TODO(), docs, options.InsertMany().SetOrdered(false)); err != nil {
+		log.Printf("SOE - Error inserting %d events: %v", len(docs), err)
+	}
+}
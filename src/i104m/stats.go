@@ -0,0 +1,91 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const statsInterval = 10 * time.Second // period to record the statistics of the connections
+
+// counters of a connection, since the start of the driver
+type connStats struct {
+	packetsReceived   atomic.Uint64 // datagrams from allowed sources
+	packetsAccepted   atomic.Uint64 // packets decoded and processed
+	packetsRejected   atomic.Uint64 // invalid or not authenticated packets
+	packetsDuplicated atomic.Uint64 // repeated packets ignored
+	packetsStandby    atomic.Uint64 // packets of secondary sources ignored while the primary is alive
+	packetsDropped    atomic.Uint64 // packets discarded with the channel full
+	pointsUpdated     atomic.Uint64 // point updates queued to realtimeData
+	commandsSent      atomic.Uint64
+	commandsAcked     atomic.Uint64 // positive confirmations (or sent when confirmations are not expected)
+	commandsRefused   atomic.Uint64 // negative confirmations
+	commandsCancelled atomic.Uint64 // not sent, not confirmed in time or superseded
+}
+
+// Returns the statistics to be recorded in the connection document
+func (protCon *protocolConnection) statsDocument(writer *batchWriter) bson.D {
+	s := protCon.stats
+	doc := bson.D{
+		{Key: "timeTag", Value: time.Now()},
+		{Key: "packetsReceived", Value: int64(s.packetsReceived.Load())},
+		{Key: "packetsAccepted", Value: int64(s.packetsAccepted.Load())},
+		{Key: "packetsRejected", Value: int64(s.packetsRejected.Load())},
+		{Key: "packetsDuplicated", Value: int64(s.packetsDuplicated.Load())},
+		{Key: "packetsStandby", Value: int64(s.packetsStandby.Load())},
+		{Key: "packetsDropped", Value: int64(s.packetsDropped.Load())},
+		{Key: "pointsUpdated", Value: int64(s.pointsUpdated.Load())},
+		{Key: "commandsSent", Value: int64(s.commandsSent.Load())},
+		{Key: "commandsAcked", Value: int64(s.commandsAcked.Load())},
+		{Key: "commandsRefused", Value: int64(s.commandsRefused.Load())},
+		{Key: "commandsCancelled", Value: int64(s.commandsCancelled.Load())},
+		{Key: "sources", Value: protCon.link.sourceList()},
+		{Key: "bulkWriteLatencyMs", Value: float64(writer.latency.Load()) / float64(time.Millisecond)},
+		{Key: "bulkWriteMaxLatencyMs", Value: float64(writer.maxLatency.Load()) / float64(time.Millisecond)},
+	}
+	return doc
+}
+
+// Records the statistics of the connections in the protocolConnections collection periodically, runs forever
+func recordStats(connections []*protocolConnection, collectionConnections *mongo.Collection, writer *batchWriter) {
+	for range time.Tick(statsInterval) {
+		if !isActive { // only the active node records
+			continue
+		}
+		for _, conn := range connections {
+			_, err := collectionConnections.UpdateOne(context.TODO(),
+				bson.D{
+					{Key: "protocolDriver", Value: driverName},
+					{Key: "protocolConnectionNumber", Value: conn.ProtocolConnectionNumber},
+				},
+				bson.D{{Key: "$set", Value: bson.D{{Key: "stats", Value: conn.statsDocument(writer)}}}},
+			)
+			if err != nil {
+				log.Printf("Stats - Connection %d error recording statistics: %v", conn.ProtocolConnectionNumber, err)
+			}
+		}
+		writer.maxLatency.Store(0) // maximum of each period
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transports of a connection
+const (
+	transportUDP       = "udp"        // datagrams (default)
+	transportTCPClient = "tcp-client" // connects to the ipAddresses
+	transportTCPServer = "tcp-server" // listens on ipAddressLocalBind
+)
+
+// On TCP each packet is sent as a frame: uint16 length (little endian) + packet (as an UDP datagram)
+const (
+	tcpFrameHeaderSize = 2
+	tcpMaxFrameSize    = maxPacketSize + authTrailerSize
+	tcpMinBackoff      = time.Second      // first wait to reconnect
+	tcpMaxBackoff      = time.Minute      // maximum wait to reconnect
+	tcpDialTimeout     = 10 * time.Second // time to establish a connection (including the TLS handshake)
+	tcpWriteTimeout    = 10 * time.Second // time to send a frame before dropping the connection
+)
+
+var (
+	errNotConnected    = errors.New("not connected")
+	errInvalidFrame    = errors.New("invalid frame length")
+	errPeerCertificate = errors.New("peer certificate not allowed")
+)
+
+// established TCP connection
+type tcpSession struct {
+	conn   net.Conn
+	remote string // IP:port
+	mu     sync.Mutex
+}
+
+// tcpTransport keeps the TCP connections of a protocol connection
+type tcpTransport struct {
+	mu        sync.Mutex
+	sessions  map[string]*tcpSession // by remote address
+	tlsConfig *tls.Config            // nil without TLS
+}
+
+// Writes a packet as a frame
+func (s *tcpSession) writeFrame(buf []byte) error {
+	frame := make([]byte, tcpFrameHeaderSize, tcpFrameHeaderSize+len(buf))
+	binary.LittleEndian.PutUint16(frame, uint16(len(buf)))
+	frame = append(frame, buf...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	_, err := s.conn.Write(frame)
+	if err != nil {
+		s.conn.Close() // the reader ends the session
+	}
+	return err
+}
+
+// Reads the next frame of a connection, returns the packet
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var hdr [tcpFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint16(hdr[:]))
+	if n == 0 || n > tcpMaxFrameSize {
+		return nil, fmt.Errorf("%w: %d", errInvalidFrame, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Sets up the TCP transport of the connection, returns an error for invalid transport or TLS configuration
+func (protCon *protocolConnection) setupTransport() error {
+	switch strings.ToLower(strings.TrimSpace(protCon.Transport)) {
+	case "", transportUDP:
+		return nil
+	case transportTCPClient, transportTCPServer:
+	default:
+		return fmt.Errorf("connection %d invalid transport %q", protCon.ProtocolConnectionNumber, protCon.Transport)
+	}
+	protCon.Transport = strings.ToLower(strings.TrimSpace(protCon.Transport))
+	if len(protCon.ForwardDestinations) > 0 {
+		return fmt.Errorf("connection %d forward destinations are only supported with the UDP transport", protCon.ProtocolConnectionNumber)
+	}
+	protCon.tcp = &tcpTransport{sessions: make(map[string]*tcpSession)}
+	if protCon.LocalCertFilePath == "" {
+		return nil
+	}
+	cfg, err := protCon.buildTLSConfig()
+	if err != nil {
+		return fmt.Errorf("connection %d TLS: %w", protCon.ProtocolConnectionNumber, err)
+	}
+	protCon.tcp.tlsConfig = cfg
+	return nil
+}
+
+// Builds the TLS configuration from the certificate files of the connection
+func (protCon *protocolConnection) buildTLSConfig() (*tls.Config, error) {
+	keyFile := protCon.PrivateKeyFilePath
+	if keyFile == "" { // certificate and key in the same file
+		keyFile = protCon.LocalCertFilePath
+	}
+	cert, err := tls.LoadX509KeyPair(protCon.LocalCertFilePath, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if protCon.RootCertFilePath != "" {
+		data, err := os.ReadFile(protCon.RootCertFilePath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", protCon.RootCertFilePath)
+		}
+		cfg.RootCAs = pool
+		cfg.ClientCAs = pool
+	}
+
+	if protCon.AllowOnlySpecificCerts {
+		var allowed [][]byte
+		for _, fileName := range protCon.PeerCertFilesPaths {
+			data, err := os.ReadFile(fileName)
+			if err != nil {
+				return nil, err
+			}
+			certs, err := parsePEMCertificates(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fileName, err)
+			}
+			allowed = append(allowed, certs...)
+		}
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, a := range allowed {
+				if len(rawCerts) > 0 && bytes.Equal(rawCerts[0], a) {
+					return nil
+				}
+			}
+			return errPeerCertificate
+		}
+	}
+
+	switch {
+	case protCon.Transport == transportTCPClient:
+		cfg.InsecureSkipVerify = !protCon.ChainValidation // the peer certificates are still checked when specific certificates are allowed
+	case protCon.ChainValidation:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case protCon.AllowOnlySpecificCerts:
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	}
+	return cfg, nil
+}
+
+// Returns the DER certificates of a PEM file
+func parsePEMCertificates(data []byte) ([][]byte, error) {
+	var certs [][]byte
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, block.Bytes)
+		}
+		data = rest
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// Sends a packet to the destination: the TCP connection with the remote address or the UDP address
+func (protCon *protocolConnection) send(buf []byte, dest string) error {
+	if protCon.tcp != nil {
+		protCon.tcp.mu.Lock()
+		s := protCon.tcp.sessions[dest]
+		protCon.tcp.mu.Unlock()
+		if s == nil {
+			return fmt.Errorf("%w: %s", errNotConnected, dest)
+		}
+		return s.writeFrame(buf)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(dest))
+	if err != nil {
+		return err
+	}
+	_, err = protCon.udpConn.WriteToUDP(buf, udpAddr)
+	return err
+}
+
+// Returns the remote addresses of the TCP connections established, sorted
+func (t *tcpTransport) peers() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var peers []string
+	for remote := range t.sessions {
+		peers = append(peers, remote)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Registers an established TCP connection as a destination of the packets sent
+func (protCon *protocolConnection) addSession(s *tcpSession) {
+	protCon.tcp.mu.Lock()
+	protCon.tcp.sessions[s.remote] = s
+	protCon.tcp.mu.Unlock()
+}
+
+// Receives the frames of a registered TCP connection until it is closed, putting the packets on the channel
+func (protCon *protocolConnection) serveTCP(s *tcpSession, chanBuf chan receivedPacket) {
+	defer func() {
+		protCon.tcp.mu.Lock()
+		delete(protCon.tcp.sessions, s.remote)
+		protCon.tcp.mu.Unlock()
+		s.conn.Close()
+	}()
+
+	var prevBuf []byte // previous packet of the connection
+	r := bufio.NewReader(s.conn)
+	for {
+		buf, err := readFrame(r)
+		if err != nil {
+			log.Printf("TCP - Connection %d to %s closed: %v", protCon.ProtocolConnectionNumber, s.remote, err)
+			return
+		}
+		if capture != nil {
+			capture.write(time.Now(), s.remote, buf)
+		}
+		protCon.stats.packetsReceived.Add(1)
+		if len(buf) <= 4 {
+			if logLevel >= logLevelDebug {
+				log.Printf("TCP - Invalid small packet. Ignored.\n")
+			}
+			continue
+		}
+		if buf, err = protCon.verify(buf, time.Now()); err != nil {
+			cntRejectedPackets.Add(1)
+			protCon.stats.packetsRejected.Add(1)
+			if logLevel >= logLevelBasic {
+				log.Printf("TCP - Message from %s rejected: %v", s.remote, err)
+			}
+			continue
+		}
+		if !protCon.ServerMode { // repeated commands are valid for server connections
+			if protCon.dedup != nil {
+				if addr, err := netip.ParseAddrPort(s.remote); err == nil && protCon.ignoreRedundant(buf, addr.Addr(), "TCP") {
+					continue
+				}
+			} else if bytes.Equal(buf, prevBuf) { // without redundant sources, only the previous packet is compared
+				protCon.stats.packetsDuplicated.Add(1)
+				if logLevel >= logLevelDebug {
+					log.Printf("TCP - Duplicated message. Ignored.\n")
+				}
+				continue
+			}
+			prevBuf = buf
+		}
+		if !isActive { // do not process packets while inactive
+			continue
+		}
+		select {
+		case chanBuf <- receivedPacket{buf: buf, conn: protCon, source: s.remote}:
+		default:
+			cntDroppedPackets.Add(1)
+			protCon.stats.packetsDropped.Add(1)
+			log.Printf("TCP - Channel is full. Discarding packet! #%d", cntDroppedPackets.Load())
+			continue
+		}
+		if logLevel >= logLevelBasic {
+			log.Printf("TCP - Enqueued received packet with %d bytes from %s for connection %d", len(buf), s.remote, protCon.ProtocolConnectionNumber)
+		}
+	}
+}
+
+// Connects to the addresses of the connection in turn, reconnecting with exponential backoff. Runs forever.
+func (protCon *protocolConnection) runTCPClient(chanBuf chan receivedPacket) {
+	addrs := protCon.IPAddresses[:0:0]
+	for _, a := range protCon.IPAddresses {
+		if _, _, err := net.SplitHostPort(strings.TrimSpace(a)); err == nil {
+			addrs = append(addrs, strings.TrimSpace(a))
+		}
+	}
+	if len(addrs) == 0 {
+		log.Printf("TCP - Connection %d has no address (IP:port) to connect!", protCon.ProtocolConnectionNumber)
+		return
+	}
+
+	backoff := tcpMinBackoff
+	for i := 0; ; i++ {
+		addr := addrs[i%len(addrs)]
+		dialer := &net.Dialer{Timeout: tcpDialTimeout, KeepAlive: 15 * time.Second}
+		var conn net.Conn
+		var err error
+		if protCon.tcp.tlsConfig != nil {
+			cfg := protCon.tcp.tlsConfig.Clone()
+			cfg.ServerName = sourceIP(addr)
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
+		} else {
+			conn, err = dialer.Dial("tcp", addr)
+		}
+		if err != nil {
+			log.Printf("TCP - Connection %d error connecting to %s: %v, retry in %s", protCon.ProtocolConnectionNumber, addr, err, backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, tcpMaxBackoff)
+			continue
+		}
+		backoff = tcpMinBackoff
+		log.Printf("TCP - Connection %d connected to %s", protCon.ProtocolConnectionNumber, addr)
+		s := &tcpSession{conn: conn, remote: conn.RemoteAddr().String()}
+		protCon.addSession(s)
+		if !protCon.ServerMode && protCon.GiInterval >= 0 && isActive { // update all points after connecting
+			protCon.sendRequest(asduInterrogation, time.Now())
+		}
+		protCon.serveTCP(s, chanBuf)
+		time.Sleep(tcpMinBackoff)
+	}
+}
+
+// Accepts connections from the allowed sources on the bind address of the connection. Runs forever.
+func (protCon *protocolConnection) runTCPServer(chanBuf chan receivedPacket) {
+	var ln net.Listener
+	var err error
+	if protCon.tcp.tlsConfig != nil {
+		ln, err = tls.Listen("tcp", protCon.IPAddressLocalBind, protCon.tcp.tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", protCon.IPAddressLocalBind)
+	}
+	checkFatalError(err)
+	log.Printf("TCP - Connection %d listening on %s", protCon.ProtocolConnectionNumber, protCon.IPAddressLocalBind)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("TCP - Connection %d accept error: %v", protCon.ProtocolConnectionNumber, err)
+			time.Sleep(tcpMinBackoff)
+			continue
+		}
+		remote := conn.RemoteAddr().String()
+		addr, err := netip.ParseAddrPort(remote)
+		if err != nil || !protCon.allowsSource(addr.Addr()) {
+			if logLevel >= logLevelBasic {
+				log.Printf("TCP - Connection %d from %s not allowed!", protCon.ProtocolConnectionNumber, remote)
+			}
+			conn.Close()
+			continue
+		}
+		log.Printf("TCP - Connection %d accepted from %s", protCon.ProtocolConnectionNumber, remote)
+		s := &tcpSession{conn: conn, remote: remote}
+		protCon.addSession(s)
+		go protCon.serveTCP(s, chanBuf)
+	}
+}
+
+// Starts the TCP client or server of the connection
+func (protCon *protocolConnection) runTCP(chanBuf chan receivedPacket) {
+	if protCon.Transport == transportTCPClient {
+		protCon.runTCPClient(chanBuf)
+	} else {
+		protCon.runTCPServer(chanBuf)
+	}
+}
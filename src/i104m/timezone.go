@@ -0,0 +1,107 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // zone names also on systems without a time zone database
+)
+
+// fixed offset from UTC, as in "-03:00", "+0530", "UTC-3" or "GMT+2"
+var offsetRegexp = regexp.MustCompile(`^(?i:UTC|GMT)?([+-])(\d{1,2})(?::?(\d{2}))?$`)
+
+// Parses the time zone of a connection: empty or "local" (time zone of the host), "UTC",
+// a fixed offset (e.g. "-03:00", "UTC+2") or a zone name (e.g. "America/Sao_Paulo")
+func parseTimeZone(zone string) (*time.Location, error) {
+	zone = strings.TrimSpace(zone)
+	switch strings.ToLower(zone) {
+	case "", "local":
+		return time.Local, nil
+	case "utc", "gmt", "z":
+		return time.UTC, nil
+	}
+	if m := offsetRegexp.FindStringSubmatch(zone); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes := 0
+		if m[3] != "" {
+			minutes, _ = strconv.Atoi(m[3])
+		}
+		if hours > 14 || minutes > 59 {
+			return nil, fmt.Errorf("invalid time zone offset %q", zone)
+		}
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(zone, offset), nil
+	}
+	return time.LoadLocation(zone)
+}
+
+// Tests if the time zone has summer time in the year of t
+func hasSummerTime(t time.Time) bool {
+	_, offsetJan := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location()).Zone()
+	_, offsetJul := time.Date(t.Year(), time.July, 1, 0, 0, 0, 0, t.Location()).Zone()
+	return offsetJan != offsetJul
+}
+
+// Adjusts a time decoded from the local time fields with the summer time (SU) bit.
+// On zones with summer time, the bit selects the instant of the hour repeated when summer time ends.
+// A local time in the hour skipped when summer time begins is taken with the offset before the change (e.g. 02:30 is 03:30 summer time).
+// On zones without summer time in the year (e.g. UTC, fixed offsets or America/Sao_Paulo since 2019), a time flagged
+// as summer time is taken as one hour ahead of the zone, so one hour is subtracted.
+func applySummerTime(t time.Time, su bool) time.Time {
+	if !hasSummerTime(t) {
+		if su {
+			return t.Add(-time.Hour)
+		}
+		return t
+	}
+	if t.IsDST() == su {
+		return t
+	}
+	for _, c := range []time.Time{t.Add(-time.Hour), t.Add(time.Hour)} {
+		if c.IsDST() == su && c.Day() == t.Day() && c.Hour() == t.Hour() && c.Minute() == t.Minute() {
+			return c
+		}
+	}
+	return t // not in the repeated hour, the bit is not consistent with the zone
+}
+
+// Returns the maximum difference of time tags to the receive time, zero when not checked
+func (protCon *protocolConnection) maxTimeSkew() time.Duration {
+	if protCon.MaxTimeSkewMs <= 0 {
+		return 0
+	}
+	return time.Duration(protCon.MaxTimeSkewMs * float64(time.Millisecond))
+}
+
+// Tests if the time tag is within the maximum difference to the receive time (inclusive), true when not checked
+func (protCon *protocolConnection) timeSkewOk(t time.Time, received time.Time) bool {
+	skew := protCon.maxTimeSkew()
+	if skew == 0 {
+		return true
+	}
+	diff := received.Sub(t)
+	return diff <= skew && diff >= -skew
+}
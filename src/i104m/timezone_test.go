@@ -0,0 +1,163 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// encodes a CP56Time2a time tag (dow 1=monday, 0=not used)
+func cp56Bytes(year, month, day, dow, hour, minute, ms int, su, iv bool) []byte {
+	b := []byte{byte(ms), byte(ms >> 8), byte(minute), byte(hour), byte(day) | byte(dow)<<5, byte(month), byte(year - 2000)}
+	if iv {
+		b[2] |= 0x80
+	}
+	if su {
+		b[3] |= 0x80
+	}
+	return b
+}
+
+func mustZone(t *testing.T, zone string) *time.Location {
+	t.Helper()
+	loc, err := parseTimeZone(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseTimeZone(t *testing.T) {
+	tests := []struct {
+		zone   string
+		offset int // seconds east of UTC on 2025-01-15
+		err    bool
+	}{
+		{"UTC", 0, false},
+		{"gmt", 0, false},
+		{"UTC-3", -3 * 3600, false},
+		{"-03:00", -3 * 3600, false},
+		{"+0530", 5*3600 + 30*60, false},
+		{"GMT+2", 2 * 3600, false},
+		{"+14:00", 14 * 3600, false},
+		{"GMT+15", 0, true},
+		{"+05:60", 0, true},
+		{"Europe/Berlin", 3600, false},
+		{"America/Sao_Paulo", -3 * 3600, false},
+		{"Mars/Olympus_Mons", 0, true},
+	}
+	for _, tt := range tests {
+		loc, err := parseTimeZone(tt.zone)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error, want error", tt.zone)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.zone, err)
+			continue
+		}
+		if _, offset := time.Date(2025, time.January, 15, 12, 0, 0, 0, loc).Zone(); offset != tt.offset {
+			t.Errorf("%q: offset %d, want %d", tt.zone, offset, tt.offset)
+		}
+	}
+	if loc, _ := parseTimeZone(""); loc != time.Local {
+		t.Errorf("empty zone is %v, want local", loc)
+	}
+}
+
+func TestCP56TimeSummerTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		zone    string
+		tag     []byte
+		applySU bool
+		want    string // UTC
+		ok      bool
+	}{
+		// Europe/Berlin: summer time from 2025-03-30 02:00 (CET) to 2025-10-26 03:00 (CEST)
+		{"winter", "Europe/Berlin", cp56Bytes(2025, 1, 15, 3, 12, 0, 0, false, false), true, "2025-01-15T11:00:00Z", true},
+		{"summer", "Europe/Berlin", cp56Bytes(2025, 7, 1, 2, 12, 0, 0, true, false), true, "2025-07-01T10:00:00Z", true},
+		{"summer without SU", "Europe/Berlin", cp56Bytes(2025, 7, 1, 2, 12, 0, 0, false, false), true, "2025-07-01T10:00:00Z", true},
+		{"winter with SU", "Europe/Berlin", cp56Bytes(2025, 1, 15, 3, 12, 0, 0, true, false), true, "2025-01-15T11:00:00Z", true},
+		{"spring gap SU=0", "Europe/Berlin", cp56Bytes(2025, 3, 30, 7, 2, 30, 0, false, false), true, "2025-03-30T01:30:00Z", true},
+		{"spring gap SU=1", "Europe/Berlin", cp56Bytes(2025, 3, 30, 7, 2, 30, 0, true, false), true, "2025-03-30T01:30:00Z", true},
+		{"after spring change", "Europe/Berlin", cp56Bytes(2025, 3, 30, 7, 3, 0, 0, true, false), true, "2025-03-30T01:00:00Z", true},
+		{"repeated hour SU=1", "Europe/Berlin", cp56Bytes(2025, 10, 26, 7, 2, 30, 0, true, false), true, "2025-10-26T00:30:00Z", true},
+		{"repeated hour SU=0", "Europe/Berlin", cp56Bytes(2025, 10, 26, 7, 2, 30, 0, false, false), true, "2025-10-26T01:30:00Z", true},
+		{"repeated hour SU ignored", "Europe/Berlin", cp56Bytes(2025, 10, 26, 7, 2, 30, 0, true, false), false, "2025-10-26T01:30:00Z", true}, // standard time
+		// zones without summer time: SU=1 is one hour ahead of the zone
+		{"UTC", "UTC", cp56Bytes(2025, 7, 1, 2, 12, 0, 0, false, false), true, "2025-07-01T12:00:00Z", true},
+		{"UTC with SU", "UTC", cp56Bytes(2025, 7, 1, 2, 12, 0, 0, true, false), true, "2025-07-01T11:00:00Z", true},
+		{"UTC with SU ignored", "UTC", cp56Bytes(2025, 7, 1, 2, 12, 0, 0, true, false), false, "2025-07-01T12:00:00Z", true},
+		{"fixed offset with SU", "-03:00", cp56Bytes(2025, 7, 1, 2, 12, 0, 0, true, false), true, "2025-07-01T14:00:00Z", true},
+		{"zone without summer time with SU", "America/Sao_Paulo", cp56Bytes(2025, 1, 15, 3, 12, 0, 0, true, false), true, "2025-01-15T14:00:00Z", true},
+		// quality
+		{"invalid bit", "UTC", cp56Bytes(2025, 3, 15, 6, 12, 30, 15000, false, true), true, "2025-03-15T12:30:15Z", false},
+		{"day of week ok", "UTC", cp56Bytes(2025, 3, 15, 6, 12, 30, 15000, false, false), true, "2025-03-15T12:30:15Z", true},
+		{"day of week not used", "UTC", cp56Bytes(2025, 3, 15, 0, 12, 30, 15000, false, false), true, "2025-03-15T12:30:15Z", true},
+		{"wrong day of week", "UTC", cp56Bytes(2025, 3, 15, 1, 12, 30, 15000, false, false), true, "2025-03-15T12:30:15Z", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cp56Time(tt.tag, mustZone(t, tt.zone), tt.applySU)
+			if s := got.UTC().Format(time.RFC3339); s != tt.want || ok != tt.ok {
+				t.Errorf("got %s %v, want %s %v", s, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEncodeCP56TimeRoundTrip(t *testing.T) {
+	loc := mustZone(t, "Europe/Berlin")
+	for _, s := range []string{"2025-10-26T00:30:00Z", "2025-10-26T01:30:00Z", "2025-03-30T01:30:00Z", "2025-07-01T10:00:00Z"} {
+		want, _ := time.Parse(time.RFC3339, s)
+		got, ok := cp56Time(encodeCP56Time(want.In(loc), true), loc, true)
+		if !got.Equal(want) || !ok {
+			t.Errorf("%s: got %s %v", s, got.UTC().Format(time.RFC3339), ok)
+		}
+	}
+}
+
+func TestTimeSkewOk(t *testing.T) {
+	received := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		maxTimeSkewMs float64
+		diff          time.Duration // time tag - receive time
+		ok            bool
+	}{
+		{0, time.Hour, true}, // not checked
+		{-1, time.Hour, true},
+		{1000, 0, true},
+		{1000, time.Second, true},
+		{1000, -time.Second, true},
+		{1000, time.Second + time.Millisecond, false},
+		{1000, -time.Second - time.Millisecond, false},
+		{0.5, 500 * time.Microsecond, true},
+		{0.5, 501 * time.Microsecond, false},
+	}
+	for _, tt := range tests {
+		pc := &protocolConnection{MaxTimeSkewMs: tt.maxTimeSkewMs}
+		if ok := pc.timeSkewOk(received.Add(tt.diff), received); ok != tt.ok {
+			t.Errorf("maxTimeSkewMs %v, diff %s: %v, want %v", tt.maxTimeSkewMs, tt.diff, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * I104M Client Protocol driver for {json:scada}
+ * {json:scada} - Copyright (c) 2020 - Ricardo L. Olsen
+ * This file is part of the JSON-SCADA distribution (https://github.com/riclolsen/json-scada).
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultWriteWindow = 100 * time.Millisecond // time to coalesce updates before writing
+	writeBatchSize     = 5000                   // points pending to force a write before the window ends
+)
+
+// batchWriter coalesces the point updates of many packets (keeping the latest value of each point)
+// and writes them with large unordered bulk writes. All SOE events are kept and recorded.
+type batchWriter struct {
+	mu         sync.Mutex
+	collection *mongo.Collection
+	soeRec     *soeRecorder
+	window     time.Duration
+	pending    map[pointAddress]mongo.WriteModel
+	events     []*soeEvent
+	full       chan struct{} // signals a batch is complete before the window ends
+
+	cntUpdates   atomic.Uint64 // point updates received
+	cntCoalesced atomic.Uint64 // point updates replaced by a newer value before written
+	cntWrites    atomic.Uint64 // bulk writes issued
+	latency      atomic.Int64  // duration of the last bulk write (ns)
+	maxLatency   atomic.Int64  // maximum duration of bulk writes (ns), reset when the statistics are recorded
+}
+
+func newBatchWriter(collection *mongo.Collection, soeRec *soeRecorder, window time.Duration) *batchWriter {
+	return &batchWriter{
+		collection: collection,
+		soeRec:     soeRec,
+		window:     window,
+		pending:    make(map[pointAddress]mongo.WriteModel),
+		full:       make(chan struct{}, 1),
+	}
+}
+
+// Queues the updates and events parsed from a packet
+func (w *batchWriter) add(addrs []pointAddress, opers []mongo.WriteModel, events []*soeEvent) {
+	w.mu.Lock()
+	for i, addr := range addrs {
+		if _, found := w.pending[addr]; found {
+			w.cntCoalesced.Add(1)
+		}
+		w.pending[addr] = opers[i]
+	}
+	w.events = append(w.events, events...)
+	full := len(w.pending) >= writeBatchSize
+	w.mu.Unlock()
+	w.cntUpdates.Add(uint64(len(opers)))
+
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Returns the number of point updates waiting to be written
+func (w *batchWriter) depth() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// Writes the pending events and updates
+func (w *batchWriter) flush() {
+	w.mu.Lock()
+	pending, events := w.pending, w.events
+	w.pending = make(map[pointAddress]mongo.WriteModel, len(pending))
+	w.events = nil
+	w.mu.Unlock()
+
+	w.soeRec.record(events)
+	if len(pending) == 0 {
+		return
+	}
+	opers := make([]mongo.WriteModel, 0, len(pending))
+	for _, oper := range pending {
+		opers = append(opers, oper)
+	}
+
+	t1 := time.Now()
+	res, err := w.collection.BulkWrite(
+		context.Background(),
+		opers,
+		options.BulkWrite().SetOrdered(false),
+	)
+	if res == nil {
+		log.Print("Mongodb - bulk error!")
+		log.Fatal(err)
+	}
+	w.cntWrites.Add(1)
+	t2 := time.Now()
+	latency := int64(t2.Sub(t1))
+	w.latency.Store(latency)
+	if latency > w.maxLatency.Load() {
+		w.maxLatency.Store(latency)
+	}
+
+	if logLevel >= logLevelDetailed {
+		log.Printf("Mongodb - Matched count: %d, Updated Count: %d, Bulk upsert time: %d ms \n", res.MatchedCount, res.ModifiedCount, t2.Sub(t1).Milliseconds())
+		if len(opers) > 20 {
+			log.Printf("Mongodb - %d bulk upserts/s\n", int64(float64(len(opers))/t2.Sub(t1).Seconds()))
+		}
+	}
+}
+
+// Writes the queued data at the end of each window, or earlier when a batch is complete. Runs forever.
+func (w *batchWriter) run() {
+	for {
+		select {
+		case <-time.After(w.window):
+		case <-w.full:
+		}
+		w.flush()
+	}
+}